@@ -1,12 +1,13 @@
 package awsiotjobs
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,70 +17,69 @@ import (
 const jobBaseTopic = "$aws/things/%s/jobs/%s"
 const publishTimeout = 2 * time.Second
 
-// Config is the configuration to connect to AWS IoT
-type Config struct {
-	Port            int
-	CaCertPath      string
-	CertificatePath string
-	PrivateKeyPath  string
-	Endpoint        string
-	ThingName       string
-	ClientID        string
-	Handler         func(je JobExecutioner)
-}
+// defaultShutdownTimeout is used when Config.ShutdownTimeout is not set
+const defaultShutdownTimeout = 30 * time.Second
 
-// FromFile reads the configuration from a JSON file
-// {
-// 	"Port":           88,
-// 	"CaCertPath":     "ca",
-// 	"CertificatePath":"cert",
-// 	"PrivateKeyPath": "key",
-// 	"Endpoint":       "ep",
-// 	"ThingName":      "tn",
-// 	"ClientID":       "cid"
-// }
-func (c *Config) FromFile(file string) error {
-	s, err := ioutil.ReadFile(file)
-	if err != nil {
-		fmt.Printf("Invalid config file - ignoring\n")
-		return err
-	}
-	json.Unmarshal(s, &c)
-	return nil
-}
+// When the connection fails, Run retries waiting from minConnectRetryDelay up to maxConnectRetryDelay,
+// doubling the delay after each failure
+var minConnectRetryDelay = time.Second
+
+const maxConnectRetryDelay = 5 * time.Minute
+
+// Updates rejected because of a version mismatch are retried up to maxUpdateAttempts times,
+// waiting an increasing multiple of updateRetryDelay between attempts
+const maxUpdateAttempts = 3
+
+var updateRetryDelay = 500 * time.Millisecond
 
 type nextJobPayload struct {
 	clientToken string
 }
 
-// NewTLSConfig creates a new TLS config
-func NewTLSConfig(caCertPath, certPath, privKeyPath string) *tls.Config {
-	certpool := x509.NewCertPool()
-	caCert, err := ioutil.ReadFile(caCertPath)
-	if err == nil {
-		certpool.AppendCertsFromPEM(caCert)
-	} else {
-		panic(err)
-	}
+// ErrNoMqttClient is returned when the Client has not been initialized with NewClient
+var ErrNoMqttClient = errors.New("awsiotjobs: MQTT client not set")
 
-	cert, err := tls.LoadX509KeyPair(certPath, privKeyPath)
-	if err != nil {
-		panic(err)
-	}
+// ErrQueued is returned by InProgress, Success, Fail and Reject when the update could not be sent, for
+// example while the connection is down, and was queued in the outbox instead: it is sent once possible, but
+// AWS IoT has not accepted it yet
+var ErrQueued = errors.New("awsiotjobs: update queued in the outbox")
 
-	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+// errSubscribeTimeout is returned when AWS IoT does not acknowledge the subscriptions within publishTimeout
+var errSubscribeTimeout = errors.New("awsiotjobs: subscription not acknowledged")
 
-	if err != nil {
-		panic(err)
-	}
+// CredentialsError is returned when the CA, the certificate or the private key cannot be loaded
+type CredentialsError struct {
+	Path string
+	Err  error
+}
 
-	return &tls.Config{
-		RootCAs:            certpool,
-		ClientAuth:         tls.NoClientCert,
-		ClientCAs:          nil,
-		InsecureSkipVerify: false,
-		Certificates:       []tls.Certificate{cert},
-	}
+func (err *CredentialsError) Error() string {
+	return fmt.Sprintf("awsiotjobs: loading credentials from %s: %s", err.Path, err.Err.Error())
+}
+
+// Unwrap returns the underlying error
+func (err *CredentialsError) Unwrap() error {
+	return err.Err
+}
+
+// ConnectError is returned when the connection to AWS IoT fails
+type ConnectError struct {
+	Broker string
+	Err    error
+}
+
+func (err *ConnectError) Error() string {
+	return fmt.Sprintf("awsiotjobs: connecting to %s: %s", err.Broker, err.Err.Error())
+}
+
+// Unwrap returns the underlying error
+func (err *ConnectError) Unwrap() error {
+	return err.Err
+}
+
+// NewTLSConfig creates a new TLS config, returning a *CredentialsError if any of the files cannot be loaded
+func NewTLSConfig(caCertPath, certPath, privKeyPath string) (*tls.Config, error) {
+	return NewTLSConfigWithKey(caCertPath, certPath, FileKey(privKeyPath))
 }
 
 // JobError contains the error code and message for a Job error
@@ -105,14 +105,16 @@ type StatusDetails map[string]interface{}
 type JobExecutioner interface {
 	GetJobDocument() JobDocument
 	GetStatusDetails() StatusDetails
+	GetLocalStatusDetails() StatusDetails
 	Publish(string, byte, interface{})
 	Success(StatusDetails) error
 	Fail(JobError) error
 	Reject(JobError) error
 	InProgress(StatusDetails) error
-	Terminate()
 	GetThingName() string
 	GetJobID() string
+	// GetLogger returns a Logger adding the thingName, jobId and executionNumber fields to the messages
+	GetLogger() Logger
 }
 
 // JobExecution represents the AWS IoT job execution document
@@ -145,6 +147,7 @@ type JobExecution struct {
 	VersionNumber   int64         `json:"versionNumber"`
 	ExecutionNumber int64         `json:"executionNumber"`
 	client          *Client
+	local           *journalEntry
 	mux             sync.Mutex
 }
 
@@ -158,9 +161,20 @@ func (je *JobExecution) GetStatusDetails() StatusDetails {
 	return je.StatusDetails
 }
 
+// GetLocalStatusDetails returns the StatusDetails of the last transition journaled on this device
+// for this execution, or nil if there is none.
+// Since the journal is written before every update is sent, this can be more recent than
+// GetStatusDetails when the last update was lost.
+func (je *JobExecution) GetLocalStatusDetails() StatusDetails {
+	if je.local == nil {
+		return nil
+	}
+	return je.local.StatusDetails
+}
+
 // GetThingName is the accessor to the ThingName
 func (je *JobExecution) GetThingName() string {
-	return je.client.config.ThingName
+	return je.client.getConfig().ThingName
 }
 
 // GetJobID is the accessor to JobID
@@ -168,29 +182,128 @@ func (je *JobExecution) GetJobID() string {
 	return je.JobID
 }
 
-func (je *JobExecution) getUpdatePayload() interface{} {
+// GetLogger returns the logger of the client with the fields of the execution
+func (je *JobExecution) GetLogger() Logger {
+	return je.client.Logger().With(F("thingName", je.GetThingName()), F("jobId", je.JobID), F("executionNumber", je.ExecutionNumber))
+}
+
+// getUpdatePayload must be called holding je.mux, the clientToken is added by the request
+func (je *JobExecution) getUpdatePayload() map[string]interface{} {
 	payload := make(map[string]interface{})
 	payload["status"] = je.Status
 	payload["statusDetails"] = je.StatusDetails
 	payload["expectedVersion"] = je.VersionNumber
 	payload["executionNumber"] = je.ExecutionNumber
 	payload["includeJobExecutionState"] = true
-	payload["clientToken"] = "client-token"
-	jsonPayload, _ := json.Marshal(payload)
-	return jsonPayload
+	return payload
 }
 
+// sendUpdate sends the current status and waits for AWS IoT to accept it.
+// If the update is rejected the returned error is a JobError with the code sent by AWS IoT,
+// for example VersionMismatch or TerminalStateReached.
+// A VersionMismatch means the execution was updated since we last saw it: in that case we fetch the
+// current state, merge our StatusDetails over it and try again.
+// If the update cannot be sent, for example while the connection is down, it is queued in the outbox and
+// sent once the connection is back, and sendUpdate returns ErrQueued.
 func (je *JobExecution) sendUpdate() error {
-	if je.client.Iot == nil {
-		log.Panic("Iot client not set")
+	if je.client.iot() == nil {
+		return ErrNoMqttClient
+	}
+	// The queued messages go first, so that AWS IoT gets the updates in order
+	err := je.client.flushOutbox()
+	if err == nil {
+		err = je.sendUpdateWithRetry()
+	}
+	if _, rejected := err.(JobError); err == nil || rejected {
+		return err
+	}
+	return je.queueUpdate(err)
+}
+
+// queueUpdate puts the current status in the outbox and returns ErrQueued, or cause if it cannot be queued
+func (je *JobExecution) queueUpdate(cause error) error {
+	payload := je.prepareUpdate()
+	// The version will have changed by the time the update is replayed, and the status
+	// reported by the device prevails anyway
+	delete(payload, "expectedVersion")
+	data, _ := json.Marshal(payload)
+	entry := outboxEntry{
+		Topic:   fmt.Sprintf("%s/update", fmt.Sprintf(jobBaseTopic, je.client.getConfig().ThingName, je.JobID)),
+		QoS:     1,
+		Payload: data,
+		JobID:   je.JobID,
+		Status:  payload["status"].(string),
+	}
+	if err := je.client.outbox.add(entry); err != nil {
+		je.GetLogger().Error("Cannot queue the update", F("status", entry.Status), F("error", err))
+		return cause
+	}
+	je.GetLogger().Warn("Update queued in the outbox", F("status", entry.Status), F("error", cause))
+	return ErrQueued
+}
+
+func (je *JobExecution) sendUpdateWithRetry() error {
+	for attempt := 1; ; attempt++ {
+		err := je.trySendUpdate()
+		jobError, ok := err.(JobError)
+		if !ok || jobError.ErrCode != "VersionMismatch" || attempt == maxUpdateAttempts {
+			return err
+		}
+		je.GetLogger().Warn("Update rejected - retrying", F("error", jobError), F("attempt", attempt))
+		time.Sleep(time.Duration(attempt) * updateRetryDelay)
+		if err := je.refresh(); err != nil {
+			return err
+		}
+	}
+}
+
+// refresh fetches the current version of the execution and merges our StatusDetails over the ones known
+// by AWS IoT
+func (je *JobExecution) refresh() error {
+	current, err := je.client.DescribeJobExecution(context.Background(), je.JobID)
+	if err != nil {
+		return err
+	}
+	je.mux.Lock()
+	defer je.mux.Unlock()
+	statusDetails := StatusDetails{}
+	for k, v := range current.StatusDetails {
+		statusDetails[k] = v
+	}
+	for k, v := range je.StatusDetails {
+		statusDetails[k] = v
+	}
+	je.StatusDetails = statusDetails
+	je.VersionNumber = current.VersionNumber
+	return nil
+}
+
+// prepareUpdate journals the current status and returns the payload of the update
+func (je *JobExecution) prepareUpdate() map[string]interface{} {
+	je.mux.Lock()
+	entry := journalEntry{
+		JobID:           je.JobID,
+		ExecutionNumber: je.ExecutionNumber,
+		Status:          je.Status,
+		StatusDetails:   je.StatusDetails,
 	}
 	payload := je.getUpdatePayload()
-	topic := fmt.Sprintf("%s/update", fmt.Sprintf(jobBaseTopic, je.client.config.ThingName, je.JobID))
-	log.Printf("Updating status with %s\non topic %s\n", string(payload.([]byte)), topic)
-	token := je.client.Iot.Publish(topic, 1, false, payload) // Send syncronously
-	if token.WaitTimeout(publishTimeout) && token.Error() != nil {
-		return token.Error()
+	je.mux.Unlock()
+	if err := je.client.journal.write(entry); err != nil {
+		je.GetLogger().Error("Failed to journal the status", F("status", entry.Status), F("error", err))
+	}
+	return payload
+}
+
+func (je *JobExecution) trySendUpdate() error {
+	payload := je.prepareUpdate()
+	topic := fmt.Sprintf("%s/update", fmt.Sprintf(jobBaseTopic, je.client.getConfig().ThingName, je.JobID))
+	je.GetLogger().Debug("Updating status", F("topic", topic), F("payload", payload))
+	resp, err := je.client.request(context.Background(), topic, payload)
+	if err != nil {
+		return err
 	}
+	je.applyUpdate(resp)
 	return nil
 }
 
@@ -200,9 +313,12 @@ The argument which is passed to the function is reported in the StatusDetails fi
 You can use InProgress in case the execution of your job will take some time or needs multiple steps and
 you need to be able to recover from an interruption.
 The next time you access the Jobs API, you'll get the pending job execution and the correspondin state.
+The call returns nil once AWS IoT has accepted the update, or a JobError carrying the code sent by AWS IoT
+if the update was rejected. If the update cannot be sent, for example while the connection is down, it is
+queued in the outbox and sent as soon as possible, and the call returns ErrQueued.
 */
 func (je *JobExecution) InProgress(statusDetails StatusDetails) error {
-	log.Printf("JOB IN_PROGRESS: %v\n", statusDetails)
+	je.GetLogger().Info("Job in progress", F("statusDetails", statusDetails))
 	je.mux.Lock()
 	je.StatusDetails = statusDetails
 	je.Status = "IN_PROGRESS"
@@ -216,19 +332,21 @@ By passing a StatusDetails structure to the function you can store some addition
 the execution.
 This function should be called to notify Device Management that the job was successfully performed.
 If there are other jobs pending, they will be immediately notified to the client.
+Like InProgress, it waits for AWS IoT to accept or reject the update, and returns ErrQueued when the update
+is queued in the outbox. The execution is then complete for the agent, which does not run the job again.
 */
 func (je *JobExecution) Success(statusDetails StatusDetails) error {
-	log.Printf("JOB SUCCEEDED: %v\n", statusDetails)
+	je.GetLogger().Info("Job succeeded", F("statusDetails", statusDetails))
 	je.mux.Lock()
 	je.StatusDetails = statusDetails
 	je.Status = "SUCCEEDED"
 	je.mux.Unlock()
 	err := je.sendUpdate()
-	if err != nil {
+	if err != nil && err != ErrQueued {
 		return err
 	}
-	je.unsubscribeFromUpdates()
-	return nil
+	je.done()
+	return err
 }
 
 /*
@@ -237,9 +355,10 @@ By passing a StatusDetails structure to the function you can store some addition
 the reason of the failure.
 This function should be called to notify Device Management that the job failed.
 If there are other jobs pending, they will be immediately notified to the client.
+It returns ErrQueued when the update is queued in the outbox, like Success.
 */
 func (je *JobExecution) Fail(err JobError) error {
-	log.Printf("JOB FAIL: %v\n", err)
+	je.GetLogger().Warn("Job failed", F("error", err))
 	je.mux.Lock()
 	je.StatusDetails = map[string]interface{}{
 		"error": err.Error(),
@@ -247,11 +366,11 @@ func (je *JobExecution) Fail(err JobError) error {
 	je.Status = "FAILED"
 	je.mux.Unlock()
 	e := je.sendUpdate()
-	if e != nil {
-		return err
+	if e != nil && e != ErrQueued {
+		return e
 	}
-	je.unsubscribeFromUpdates()
-	return nil
+	je.done()
+	return e
 }
 
 /*
@@ -260,9 +379,10 @@ compulsory information.
 By passing a StatusDetails structure to the function you can store some additional information regarding
 the reason of the rejection.
 If there are other jobs pending, they will be immediately notified to the client.
+It returns ErrQueued when the update is queued in the outbox, like Success.
 */
 func (je *JobExecution) Reject(err JobError) error {
-	log.Printf("JOB REJECTED: %v\n", err)
+	je.GetLogger().Warn("Job rejected", F("error", err))
 	je.mux.Lock()
 	je.StatusDetails = map[string]interface{}{
 		"error": err.Error(),
@@ -270,21 +390,17 @@ func (je *JobExecution) Reject(err JobError) error {
 	je.Status = "REJECTED"
 	je.mux.Unlock()
 	e := je.sendUpdate()
-	if e != nil {
-		return err
+	if e != nil && e != ErrQueued {
+		return e
 	}
-	je.unsubscribeFromUpdates()
-	return nil
-}
-
-// Terminate the job execution if the process has to stop
-func (je *JobExecution) Terminate() {
-	je.client.unsubscribe()
+	je.done()
+	return e
 }
 
-// Publish is a wrapper on the mqtt Publish
+// Publish is a wrapper on the mqtt Publish. A []byte or string payload which cannot be published, or
+// which would overtake the messages waiting in the outbox, is queued and sent once the connection is back.
 func (je *JobExecution) Publish(topic string, qos byte, payload interface{}) {
-	je.client.Iot.Publish(topic, qos, false, payload)
+	je.client.publish(topic, qos, payload)
 }
 
 // Internal types used to decode the updates
@@ -298,29 +414,150 @@ type updatePayload struct {
 	ExecutionState executionStateType `json:"executionState"`
 }
 
-func (je *JobExecution) updateHandler(client mqtt.Client, msg mqtt.Message) {
+// applyUpdate refreshes the execution with the state returned in an update/accepted message
+func (je *JobExecution) applyUpdate(msg []byte) {
 	payload := updatePayload{}
-	json.Unmarshal(msg.Payload(), &payload)
-	log.Printf("%v\n", payload)
+	json.Unmarshal(msg, &payload)
+	je.GetLogger().Debug("Update accepted", F("status", payload.ExecutionState.Status), F("versionNumber", payload.ExecutionState.VersionNumber))
 	je.mux.Lock()
 	je.VersionNumber = payload.ExecutionState.VersionNumber
 	je.StatusDetails = payload.ExecutionState.StatusDetails
 	je.mux.Unlock()
 }
 
-func (je *JobExecution) subscribeToUpdates() {
-	updateTopic := fmt.Sprintf(jobBaseTopic, je.client.config.ThingName, "+/update/accepted")
-	je.client.Iot.Subscribe(updateTopic, 0, je.updateHandler)
+// done is called once a terminal status has been accepted, the local state is no longer needed
+func (je *JobExecution) done() {
+	je.mux.Lock()
+	status := je.Status
+	je.mux.Unlock()
+	je.client.stats.onJobDone(status)
+	je.client.executions.remove(je)
+	if err := je.client.journal.remove(je.JobID); err != nil {
+		je.GetLogger().Error("Failed to remove the journal", F("error", err))
+	}
+}
+
+func isTerminal(status string) bool {
+	switch status {
+	case "SUCCEEDED", "FAILED", "REJECTED":
+		return true
+	}
+	return false
+}
+
+// loadLocalState reads the journal for the execution and discards it if it belongs to a previous execution
+func (je *JobExecution) loadLocalState() {
+	entry, err := je.client.journal.read(je.JobID)
+	if err != nil {
+		je.GetLogger().Error("Failed to read the journal", F("error", err))
+		return
+	}
+	if entry == nil {
+		return
+	}
+	if entry.ExecutionNumber != je.ExecutionNumber {
+		je.client.journal.remove(je.JobID)
+		return
+	}
+	je.local = entry
+}
+
+// resumeTerminal re-sends a terminal status that was journaled but never reached AWS IoT,
+// for example because the device rebooted right after the handler completed.
+func (je *JobExecution) resumeTerminal() {
+	je.GetLogger().Info("Resending the journaled status", F("status", je.local.Status))
+	je.mux.Lock()
+	je.Status = je.local.Status
+	je.StatusDetails = je.local.StatusDetails
+	je.mux.Unlock()
+	err := je.sendUpdate()
+	if err != nil && err != ErrQueued {
+		je.GetLogger().Error("Failed to resend the status", F("error", err))
+		return
+	}
+	je.done()
+}
+
+// executions keeps track of the job executions in flight, by job ID
+type executions struct {
+	byJobID map[string]*JobExecution
+	mux     sync.Mutex
+}
+
+func newExecutions() *executions {
+	return &executions{byJobID: make(map[string]*JobExecution)}
+}
+
+// add tracks je and returns false if the same execution is already in flight
+func (e *executions) add(je *JobExecution) bool {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if current, ok := e.byJobID[je.JobID]; ok && current.ExecutionNumber == je.ExecutionNumber {
+		return false
+	}
+	e.byJobID[je.JobID] = je
+	return true
+}
+
+func (e *executions) remove(je *JobExecution) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if e.byJobID[je.JobID] == je {
+		delete(e.byJobID, je.JobID)
+	}
+}
+
+func (e *executions) get(jobID string) *JobExecution {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.byJobID[jobID]
+}
+
+func (e *executions) list() []*JobExecution {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	list := make([]*JobExecution, 0, len(e.byJobID))
+	for _, je := range e.byJobID {
+		list = append(list, je)
+	}
+	return list
+}
+
+func (e *executions) len() int {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return len(e.byJobID)
+}
+
+// updateHandler dispatches the update/accepted messages to the job execution they refer to.
+// The topic is $aws/things/<thingName>/jobs/<jobId>/update/accepted
+func (client *Client) updateHandler(mqttClient mqtt.Client, msg mqtt.Message) {
+	// Responses to our own updates are handled by sendUpdate
+	if client.acceptedHandler(msg) {
+		return
+	}
+	levels := strings.Split(msg.Topic(), "/")
+	if len(levels) < 3 {
+		return
+	}
+	je := client.executions.get(levels[len(levels)-3])
+	if je == nil {
+		client.defaultHandler(mqttClient, msg)
+		return
+	}
+	je.applyUpdate(msg.Payload())
 }
 
-func (je *JobExecution) unsubscribeFromUpdates() {
-	updateTopic := fmt.Sprintf(jobBaseTopic, je.client.config.ThingName, "+/update/accepted")
-	je.client.Iot.Unsubscribe(updateTopic)
+// unexpectedMessage returns the handler logging the messages nobody is waiting for, like the responses to
+// requests which timed out
+func unexpectedMessage(logger Logger) mqtt.MessageHandler {
+	return func(_ mqtt.Client, msg mqtt.Message) {
+		logger.Info("Unexpected message", F("topic", msg.Topic()), F("payload", msg.Payload()))
+	}
 }
 
-var defaultHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	log.Printf("Topic: %s\n", msg.Topic())
-	log.Printf("Msg: %s\n", msg.Payload())
+func (client *Client) defaultHandler(mqttClient mqtt.Client, msg mqtt.Message) {
+	unexpectedMessage(client.Logger())(mqttClient, msg)
 }
 
 func parseJobMessage(msg []byte) (*JobExecution, error) {
@@ -339,36 +576,76 @@ func parseJobMessage(msg []byte) (*JobExecution, error) {
 func (client *Client) jobHandler(mqttClient mqtt.Client, msg mqtt.Message) {
 	job, err := parseJobMessage(msg.Payload())
 	if err != nil {
-		fmt.Printf("Not a job - Ignoring, %s\n", err.Error())
+		client.Logger().Warn("Not a job - Ignoring", F("topic", msg.Topic()), F("error", err))
 		return
 	}
 	job.client = client
-	job.ThingName = client.config.ThingName // This is so the specialized jobs can access the property
-	job.subscribeToUpdates()
-	go job.client.config.Handler(job)
+	job.ThingName = client.getConfig().ThingName // This is so the specialized jobs can access the property
+	if client.outbox.hasTerminal(job.JobID) {
+		job.GetLogger().Info("Final status waiting in the outbox - Ignoring")
+		return
+	}
+	if !client.executions.add(job) {
+		job.GetLogger().Debug("Already in progress - Ignoring")
+		return
+	}
+	client.stats.onJobReceived()
+	job.loadLocalState()
+	ctx := client.handlerContext()
+	client.handlers.Add(1)
+	go func() {
+		defer client.handlers.Done()
+		// Without an accepted final status the job can be delivered again, e.g. after a failed Fail
+		defer client.executions.remove(job)
+		if job.local != nil && isTerminal(job.local.Status) && !isTerminal(job.Status) {
+			job.resumeTerminal()
+			return
+		}
+		client.getConfig().Handler(ctx, job)
+	}()
 }
 
-func (client *Client) subscribe() {
-	thingName := client.config.ThingName
-	client.Iot.Subscribe(fmt.Sprintf(jobBaseTopic, thingName, "notify-next"), 0, client.jobHandler)
-	client.Iot.Subscribe(fmt.Sprintf(jobBaseTopic, thingName, "+/get/accepted"), 0, client.jobHandler)
-	client.Iot.Subscribe(fmt.Sprintf(jobBaseTopic, thingName, "+/get/rejected"), 0, defaultHandler)
-	client.Iot.Subscribe(fmt.Sprintf(jobBaseTopic, thingName, "start-next/accepted"), 0, client.jobHandler)
-	client.Iot.Subscribe(fmt.Sprintf(jobBaseTopic, thingName, "start-next/rejected"), 0, defaultHandler)
+// jobTopics returns the handlers of the job topics, by topic filter. The +/get and +/update filters cover
+// the topics of every job execution in flight.
+func (client *Client) jobTopics() map[string]mqtt.MessageHandler {
+	thingName := client.getConfig().ThingName
+	return map[string]mqtt.MessageHandler{
+		fmt.Sprintf(jobBaseTopic, thingName, "notify-next"):         client.jobHandler,
+		fmt.Sprintf(jobBaseTopic, thingName, "+/get/accepted"):      client.getAcceptedHandler,
+		fmt.Sprintf(jobBaseTopic, thingName, "+/get/rejected"):      client.rejectedHandler,
+		fmt.Sprintf(jobBaseTopic, thingName, "get/accepted"):        client.responseHandler,
+		fmt.Sprintf(jobBaseTopic, thingName, "get/rejected"):        client.rejectedHandler,
+		fmt.Sprintf(jobBaseTopic, thingName, "start-next/accepted"): client.jobHandler,
+		fmt.Sprintf(jobBaseTopic, thingName, "start-next/rejected"): client.defaultHandler,
+		fmt.Sprintf(jobBaseTopic, thingName, "+/update/accepted"):   client.updateHandler,
+		fmt.Sprintf(jobBaseTopic, thingName, "+/update/rejected"):   client.rejectedHandler,
+	}
 }
 
-func (client *Client) unsubscribe() {
-	thingName := client.config.ThingName
-	client.Iot.Unsubscribe(fmt.Sprintf(jobBaseTopic, thingName, "notify-next"))
-	client.Iot.Unsubscribe(fmt.Sprintf(jobBaseTopic, thingName, "+/get/accepted"))
-	client.Iot.Unsubscribe(fmt.Sprintf(jobBaseTopic, thingName, "+/get/rejected"))
-	client.Iot.Unsubscribe(fmt.Sprintf(jobBaseTopic, thingName, "start-next/accepted"))
-	client.Iot.Unsubscribe(fmt.Sprintf(jobBaseTopic, thingName, "start-next/rejected"))
+// subscribe subscribes to the job topics and waits for AWS IoT to acknowledge the subscriptions
+func (client *Client) subscribe() error {
+	iot := client.iot()
+	var tokens []mqtt.Token
+	for topic, handler := range client.jobTopics() {
+		tokens = append(tokens, iot.Subscribe(topic, 0, handler))
+	}
+	for _, t := range tokens {
+		if !t.WaitTimeout(publishTimeout) {
+			return errSubscribeTimeout
+		}
+		if t.Error() != nil {
+			return t.Error()
+		}
+	}
+	return nil
 }
 
-// NewConfig return a new config object with the default paramters
-func NewConfig() Config {
-	return Config{}
+func (client *Client) unsubscribe() {
+	var topics []string
+	for topic := range client.jobTopics() {
+		topics = append(topics, topic)
+	}
+	client.iot().Unsubscribe(topics...)
 }
 
 // IMqttClient represents the Mqtt client interface used by this library, allows also for better testability
@@ -377,40 +654,427 @@ type IMqttClient interface {
 	Subscribe(string, byte, mqtt.MessageHandler) mqtt.Token
 	Unsubscribe(...string) mqtt.Token
 	Connect() mqtt.Token
+	Disconnect(uint)
 }
 
 // Client defines the client for connecting to AWSIoTJobs.
 type Client struct {
-	Iot    IMqttClient //mqtt.Client
-	config Config
+	Iot         IMqttClient //mqtt.Client
+	config      Config
+	journal     *journal
+	requests    *requests
+	executions  *executions
+	outbox      *outbox
+	ctx         context.Context
+	reconnect   context.CancelFunc // cancels the reconnection started by connectionLost
+	shutdown    bool               // set by Shutdown, no reconnection is started afterwards
+	handlers    sync.WaitGroup
+	mux         sync.Mutex
+	reconfigure sync.Mutex  // serializes Reconfigure
+	credentials credentials // the credential files the MQTT client was built from
+	certificate *x509.Certificate
+	stats       clientStats
+	logger      Logger
 }
 
-func (client *Client) init(c Config) {
+// broker returns the URL of the endpoint, without the signature for the WebSocket transport
+func broker(c Config) string {
+	if c.Transport == transportWebSocket {
+		return fmt.Sprintf("wss://%s:%d/mqtt", c.Endpoint, c.Port)
+	}
+	return fmt.Sprintf("ssl://%s:%d", c.Endpoint, c.Port)
+}
+
+func (client *Client) init(c Config) error {
 	client.config = c
+	client.logger = c.logger()
+	client.journal = newJournal(c.StateDir)
+	client.requests = newRequests()
+	client.executions = newExecutions()
+	client.outbox = newOutbox(outboxDir(c.StateDir), client.logger)
+	client.credentials, _ = readCredentials(c)
+	client.certificate = usedCertificate(c)
+	iot, err := newMqttClient(c, client.connectionLost)
+	if err != nil {
+		return err
+	}
+	client.Iot = iot
+	return nil
+}
+
+// newMqttClient builds the MQTT client for c, reading the certificates. onLost is called when the connection
+// is lost: paho does not reconnect automatically, since with a clean session the subscriptions would be lost,
+// the connection is restored by Client.connectionLost instead. It is a variable for the tests.
+var newMqttClient = func(c Config, onLost mqtt.ConnectionLostHandler) (IMqttClient, error) {
+	tlsConfig, err := newTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := proxyURL(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Transport == transportWebSocket {
+		return newWebSocketClient(c, tlsConfig, proxy, onLost), nil
+	}
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("ssl://%s:%d", c.Endpoint, c.Port))
-	opts.SetClientID(c.ClientID).SetTLSConfig(NewTLSConfig(c.CaCertPath, c.CertificatePath, c.PrivateKeyPath))
-	opts.SetDefaultPublishHandler(defaultHandler)
-	opts.SetAutoReconnect(true)
-	opts.SetMaxReconnectInterval(10 * time.Minute)
-	client.Iot = mqtt.NewClient(opts)
+	opts.AddBroker(broker(c))
+	opts.SetClientID(c.ClientID).SetTLSConfig(tlsConfig)
+	if proxy != nil {
+		opts.SetCustomOpenConnectionFn(openProxiedTLSConnection(proxy, tlsConfig))
+	}
+	opts.SetDefaultPublishHandler(unexpectedMessage(c.logger()))
+	opts.SetAutoReconnect(false)
+	opts.SetConnectionLostHandler(onLost)
+	return mqtt.NewClient(opts), nil
+}
+
+// iot returns the MQTT client, which is replaced by Reconfigure
+func (client *Client) iot() IMqttClient {
+	client.mux.Lock()
+	defer client.mux.Unlock()
+	return client.Iot
+}
+
+// getConfig returns the current configuration, which is replaced by Reconfigure
+func (client *Client) getConfig() Config {
+	client.mux.Lock()
+	defer client.mux.Unlock()
+	return client.config
+}
+
+func (client *Client) setConfig(c Config, iot IMqttClient) {
+	client.mux.Lock()
+	defer client.mux.Unlock()
+	client.config = c
+	client.Iot = iot
+	client.logger = c.logger()
+}
+
+// Logger returns the logger of the agent, Config.Logger or the one writing to the standard error as set by
+// Config.LogFormat and Config.LogLevel
+func (client *Client) Logger() Logger {
+	client.mux.Lock()
+	defer client.mux.Unlock()
+	if client.logger == nil {
+		client.logger = client.config.logger()
+	}
+	return client.logger
 }
 
 // NewClient returns a new AWSIoTJobsClient using the configuration
-func NewClient(config Config) Client {
-	client := Client{}
-	client.init(config)
-	return client
-}
-
-// ConnectAndSubscribe connects to AWS IoT Core and subscribed to the job topics
-func (client *Client) ConnectAndSubscribe() {
-	fmt.Println("ConnectAndSubscribe - Connecting")
-	if token := client.Iot.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
-	}
-	client.subscribe()
-	fmt.Println("ConnectAndSubscribe - Checking for jobs")
-	client.Iot.Publish(fmt.Sprintf(jobBaseTopic, client.config.ThingName, "start-next"), 1, false, "")
-	log.Println("ConnectAndSubscribe - Done")
+func NewClient(config Config) (*Client, error) {
+	client := &Client{}
+	if err := client.init(config); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// handlerContext returns the context passed to the job handlers, which is cancelled when Run terminates
+func (client *Client) handlerContext() context.Context {
+	client.mux.Lock()
+	defer client.mux.Unlock()
+	if client.ctx == nil {
+		return context.Background()
+	}
+	return client.ctx
+}
+
+/*
+Run connects to AWS IoT, subscribes to the job topics and dispatches the jobs to the handler until ctx is done.
+If the connection fails Run keeps retrying, waiting longer after each failure.
+From the start, it logs the expiry of the certificate and checks the credential files every
+Config.CertificateCheckInterval, reconnecting when they are rotated. Once connected, it publishes the expiry
+report, see Client.checkExpiry, and the Stats of the connection on Config.TelemetryTopic, and sends the
+messages queued in the outbox.
+The handlers get a context which is cancelled together with ctx: they should then persist their state and return.
+Run then calls Shutdown, giving the handlers up to Config.ShutdownTimeout to complete.
+*/
+func (client *Client) Run(ctx context.Context) error {
+	client.mux.Lock()
+	client.ctx = ctx
+	client.mux.Unlock()
+	// The credentials are watched from the start, a device with an expired certificate can only connect
+	// once it has been rotated
+	var monitors sync.WaitGroup
+	monitors.Add(1)
+	go func() {
+		client.watchCredentials(ctx)
+		monitors.Done()
+	}()
+	// An expired certificate is reported before connecting, since the connection would only fail
+	if report, ok := client.expiryReport(); ok {
+		client.logExpiry(report)
+	}
+	if err := client.connectWithRetry(ctx); err != nil {
+		monitors.Wait()
+		return nil // cancelled before connecting, there is nothing to shut down
+	}
+	monitors.Add(3)
+	go func() {
+		client.monitorExpiry(ctx)
+		monitors.Done()
+	}()
+	go func() {
+		client.flushQueued(ctx)
+		monitors.Done()
+	}()
+	go func() {
+		client.publishStats(ctx)
+		monitors.Done()
+	}()
+	<-ctx.Done()
+	monitors.Wait() // the credential watcher must not reconnect during Shutdown
+
+	timeout := time.Duration(client.getConfig().ShutdownTimeout)
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return client.Shutdown(shutdownCtx)
+}
+
+/*
+Shutdown waits for the job handlers to return and for the status updates in flight to be answered,
+then stops reconnecting, unsubscribes and disconnects from AWS IoT.
+If ctx is done before the handlers and the updates complete, Shutdown disconnects anyway and returns ctx.Err().
+*/
+func (client *Client) Shutdown(ctx context.Context) error {
+	logger := client.Logger()
+	logger.Info("Shutdown - Waiting for job handlers")
+	err := waitContext(ctx, &client.handlers)
+	if err != nil {
+		logger.Warn("Shutdown - Job handlers still running", F("error", err))
+	}
+	logger.Info("Shutdown - Flushing status updates")
+	if e := client.requests.wait(ctx); e != nil {
+		logger.Warn("Shutdown - Status updates still pending", F("error", e))
+		err = e
+	}
+	// A reconnection in progress would subscribe again and ask for the next job once unsubscribed
+	client.mux.Lock()
+	client.shutdown = true
+	client.mux.Unlock()
+	client.stopReconnect()
+	client.reconfigure.Lock()
+	defer client.reconfigure.Unlock()
+	client.unsubscribe()
+	client.iot().Disconnect(250)
+	client.stats.onDisconnect()
+	logger.Info("Shutdown - Disconnected")
+	return err
+}
+
+// ConnectAndSubscribe connects to AWS IoT Core and subscribed to the job topics.
+// It returns a *ConnectError if the connection fails.
+// It is called again by Client.connectionLost after every disconnection, see Client.onConnect.
+func (client *Client) ConnectAndSubscribe() error {
+	iot, config := client.iot(), client.getConfig()
+	if iot == nil {
+		return ErrNoMqttClient
+	}
+	client.Logger().Info("Connecting", F("broker", broker(config)), F("clientId", config.ClientID))
+	if token := iot.Connect(); token.Wait() && token.Error() != nil {
+		client.stats.onConnectError(token.Error())
+		return &ConnectError{broker(config), token.Error()}
+	}
+	client.stats.onConnect()
+	if err := client.onConnect(); err != nil {
+		iot.Disconnect(250)
+		client.stats.onConnectError(err)
+		client.stats.onDisconnect()
+		return &ConnectError{broker(config), err}
+	}
+	client.Logger().Info("Connected", F("broker", broker(config)))
+	return nil
+}
+
+/*
+onConnect restores the state of a new connection: the job topics are subscribed, the queued messages sent
+and the next job requested with start-next. Since the updates of the executions in flight may have been
+missed while disconnected, the pending jobs are then queried to resynchronize them, see Client.resync.
+*/
+func (client *Client) onConnect() error {
+	config := client.getConfig()
+	if err := client.subscribe(); err != nil {
+		return fmt.Errorf("subscribing to the job topics: %w", err)
+	}
+	// The final statuses must reach AWS IoT before checking for jobs, otherwise the jobs would run again
+	if n := client.outbox.len(); n > 0 {
+		client.Logger().Info("Sending the queued messages", F("queued", n))
+		if err := client.flushOutbox(); err != nil {
+			client.Logger().Warn("Cannot send the queued messages", F("queued", client.outbox.len()), F("error", err))
+			client.outbox.wake() // flushQueued tries again
+		}
+	}
+	client.Logger().Debug("Checking for jobs")
+	client.mqttPublish(fmt.Sprintf(jobBaseTopic, config.ThingName, "start-next"), 1, "")
+	if client.executions.len() > 0 {
+		go client.resync(client.handlerContext())
+	}
+	return nil
+}
+
+// resync compares the executions in flight with the pending jobs of the thing: the version numbers are
+// refreshed, and the executions which are no longer pending, for example because the job was cancelled
+// while disconnected, are reported.
+func (client *Client) resync(ctx context.Context) {
+	pending, err := client.GetPendingJobs(ctx)
+	if err != nil {
+		client.Logger().Warn("Resync - Cannot get the pending jobs", F("error", err))
+		return
+	}
+	summaries := make(map[string]JobExecutionSummary)
+	for _, summary := range append(pending.InProgressJobs, pending.QueuedJobs...) {
+		summaries[summary.JobID] = summary
+	}
+	for _, je := range client.executions.list() {
+		summary, ok := summaries[je.JobID]
+		if !ok || summary.ExecutionNumber != je.ExecutionNumber {
+			je.GetLogger().Warn("Resync - The job is no longer pending, it may have been cancelled")
+			continue
+		}
+		je.mux.Lock()
+		if summary.VersionNumber > je.VersionNumber {
+			je.VersionNumber = summary.VersionNumber
+		}
+		je.mux.Unlock()
+	}
+}
+
+/*
+Reconfigure applies a new configuration to the running client: the TLS configuration is rebuilt from the
+certificate files and the client reconnects, possibly to another endpoint or with another client ID.
+The job executions in flight are kept and send their next status updates through the new connection.
+The Handler and the Logger are kept if nil in c. StateDir cannot be changed, and ThingName only when no job
+execution is in flight, since the executions belong to the thing.
+If the new connection fails, the client reconnects with the previous configuration and the error is returned.
+A reconnection in progress after a connection loss is stopped, Reconfigure connects in its place.
+*/
+func (client *Client) Reconfigure(c Config) error {
+	client.reconfigure.Lock()
+	defer client.reconfigure.Unlock()
+	old, oldIot := client.getConfig(), client.iot()
+	// Reconfigure connects by itself, a reconnection in progress would connect the new client a second time
+	client.stopReconnect()
+	if c.Handler == nil {
+		c.Handler = old.Handler
+	}
+	if c.Logger == nil {
+		c.Logger = old.Logger
+	}
+	if c.StateDir != old.StateDir {
+		return fmt.Errorf("StateDir cannot be changed without restarting the agent")
+	}
+	if c.ThingName != old.ThingName && client.executions.len() > 0 {
+		return fmt.Errorf("ThingName cannot be changed while job executions are in progress")
+	}
+	// read errors are reported by newMqttClient
+	creds, _ := readCredentials(c)
+	cert := usedCertificate(c)
+	iot, err := newMqttClient(c, client.connectionLost)
+	if err != nil {
+		return err
+	}
+
+	// AWS IoT drops a connection when another one uses the same client ID, so the old client must be
+	// disconnected first, otherwise both would keep reconnecting
+	client.Logger().Info("Reconfigure - Disconnecting")
+	if oldIot != nil {
+		client.unsubscribe()
+		oldIot.Disconnect(250)
+		client.stats.onDisconnect()
+	}
+	client.setConfig(c, iot)
+	if err = client.ConnectAndSubscribe(); err != nil {
+		client.Logger().Error("Reconfigure - Restoring the previous configuration", F("error", err))
+		client.setConfig(old, oldIot)
+		if e := client.ConnectAndSubscribe(); e != nil {
+			client.Logger().Error("Reconfigure - Cannot reconnect with the previous configuration", F("error", e))
+			go client.connectWithRetry(client.startReconnect())
+		}
+		return err
+	}
+	client.setCredentials(creds, cert)
+	client.checkExpiry()
+	return nil
+}
+
+// connectionLost reconnects and subscribes again
+func (client *Client) connectionLost(_ mqtt.Client, err error) {
+	client.Logger().Warn("Connection lost - Reconnecting", F("error", err))
+	client.stats.onConnectionLost(err)
+	go client.connectWithRetry(client.startReconnect())
+}
+
+// startReconnect returns the context of a new reconnection, cancelling the previous one. It is done when
+// Run terminates or when Reconfigure takes over the connection, and from the start after Shutdown.
+func (client *Client) startReconnect() context.Context {
+	client.mux.Lock()
+	defer client.mux.Unlock()
+	if client.reconnect != nil {
+		client.reconnect()
+	}
+	parent := client.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	if client.shutdown {
+		cancel()
+		return ctx
+	}
+	client.reconnect = cancel
+	return ctx
+}
+
+func (client *Client) stopReconnect() {
+	client.mux.Lock()
+	defer client.mux.Unlock()
+	if client.reconnect != nil {
+		client.reconnect()
+		client.reconnect = nil
+	}
+}
+
+// tryConnect connects unless the client is already connected, for example by Reconfigure while the caller
+// was waiting to retry, with the credential files as they are now. It holds client.reconfigure so that the
+// attempt does not overlap with Reconfigure.
+func (client *Client) tryConnect(ctx context.Context) error {
+	client.reconfigure.Lock()
+	defer client.reconfigure.Unlock()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if client.stats.isConnected() {
+		return nil
+	}
+	client.refreshCredentials()
+	return client.ConnectAndSubscribe()
+}
+
+// connectWithRetry connects with tryConnect until it succeeds or ctx is done
+func (client *Client) connectWithRetry(ctx context.Context) error {
+	delay := minConnectRetryDelay
+	for {
+		err := client.tryConnect(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		client.Logger().Warn("Connection failed", F("error", err), F("retryIn", delay))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxConnectRetryDelay {
+			delay = maxConnectRetryDelay
+		}
+	}
 }
@@ -0,0 +1,452 @@
+package awsiotjobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestUpdateAccepted(t *testing.T) {
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	je := &JobExecution{JobID: "job1", VersionNumber: 1, client: client}
+	client.executions.add(je)
+	var tokens []string
+	iot.onPublish = func(topic string, payload []byte) {
+		if topic != "$aws/things/thing/jobs/job1/update" {
+			return
+		}
+		tokens = append(tokens, clientToken(payload))
+		iot.deliver(topic+"/accepted", map[string]interface{}{
+			"clientToken": clientToken(payload),
+			"executionState": map[string]interface{}{
+				"status":        "IN_PROGRESS",
+				"statusDetails": map[string]interface{}{"step": "installing"},
+				"versionNumber": 2,
+			},
+		})
+	}
+
+	if err := je.InProgress(StatusDetails{"step": "installing"}); err != nil {
+		t.Fatal(err)
+	}
+	if je.VersionNumber != 2 {
+		t.Errorf("expected version 2, got %d", je.VersionNumber)
+	}
+	if err := je.InProgress(StatusDetails{"step": "rebooting"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0] == tokens[1] {
+		t.Errorf("expected a different clientToken for every update, got %v", tokens)
+	}
+}
+
+func TestUpdateRejected(t *testing.T) {
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	je := &JobExecution{JobID: "job1", VersionNumber: 1, client: client}
+	client.executions.add(je)
+	iot.onPublish = func(topic string, payload []byte) {
+		iot.deliver(topic+"/rejected", map[string]interface{}{
+			"clientToken": clientToken(payload),
+			"code":        "TerminalStateReached",
+			"message":     "job is already in a terminal state",
+		})
+	}
+
+	err := je.Success(StatusDetails{"step": "committed"})
+	jobError, ok := err.(JobError)
+	if !ok || jobError.ErrCode != "TerminalStateReached" {
+		t.Errorf("expected TerminalStateReached JobError, got %v", err)
+	}
+	err = je.Fail(JobError{ErrCode: "ERR", ErrMessage: "failed"})
+	jobError, ok = err.(JobError)
+	if !ok || jobError.ErrCode != "TerminalStateReached" {
+		t.Errorf("expected Fail to return the rejection, got %v", err)
+	}
+}
+
+func TestUpdateRetriedOnVersionMismatch(t *testing.T) {
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	je := &JobExecution{JobID: "job1", VersionNumber: 1, client: client}
+	client.executions.add(je)
+	defer func(delay time.Duration) { updateRetryDelay = delay }(updateRetryDelay)
+	updateRetryDelay = time.Millisecond
+	var sent []map[string]interface{}
+	iot.onPublish = func(topic string, payload []byte) {
+		switch topic {
+		case "$aws/things/thing/jobs/job1/get":
+			iot.deliver(topic+"/accepted", map[string]interface{}{
+				"clientToken": clientToken(payload),
+				"execution": map[string]interface{}{
+					"jobId":         "job1",
+					"status":        "IN_PROGRESS",
+					"statusDetails": map[string]interface{}{"step": "installing", "attempts": "2"},
+					"versionNumber": 5,
+				},
+			})
+		case "$aws/things/thing/jobs/job1/update":
+			var update map[string]interface{}
+			json.Unmarshal(payload, &update)
+			sent = append(sent, update)
+			if len(sent) == 1 {
+				iot.deliver(topic+"/rejected", map[string]interface{}{
+					"clientToken": clientToken(payload),
+					"code":        "VersionMismatch",
+				})
+				return
+			}
+			iot.deliver(topic+"/accepted", map[string]interface{}{
+				"clientToken":    clientToken(payload),
+				"executionState": map[string]interface{}{"versionNumber": 6},
+			})
+		}
+	}
+
+	if err := je.InProgress(StatusDetails{"step": "rebooting"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2 {
+		t.Fatalf("expected 2 updates, got %d", len(sent))
+	}
+	if sent[1]["expectedVersion"] != float64(5) {
+		t.Errorf("expected retry with version 5, got %v", sent[1]["expectedVersion"])
+	}
+	wanted := map[string]interface{}{"step": "rebooting", "attempts": "2"}
+	if !reflect.DeepEqual(sent[1]["statusDetails"], wanted) {
+		t.Errorf("\nwanted: %v,\ngot     %v", wanted, sent[1]["statusDetails"])
+	}
+	if je.VersionNumber != 6 {
+		t.Errorf("expected version 6, got %d", je.VersionNumber)
+	}
+}
+
+func TestUpdatesDispatchedByJobID(t *testing.T) {
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	job1 := &JobExecution{JobID: "job1", VersionNumber: 1, client: client}
+	job2 := &JobExecution{JobID: "job2", VersionNumber: 1, client: client}
+	client.executions.add(job1)
+	client.executions.add(job2)
+
+	iot.deliver("$aws/things/thing/jobs/job2/update/accepted", map[string]interface{}{
+		"executionState": map[string]interface{}{"versionNumber": 3},
+	})
+	if job1.VersionNumber != 1 || job2.VersionNumber != 3 {
+		t.Errorf("expected only job2 to be updated, got versions %d and %d", job1.VersionNumber, job2.VersionNumber)
+	}
+
+	client.executions.remove(job1)
+	if client.executions.get("job2") != job2 {
+		t.Error("removing job1 must not affect job2")
+	}
+}
+
+func TestRunCancelsHandlers(t *testing.T) {
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	stopped := make(chan struct{})
+	client.config.Handler = func(ctx context.Context, je JobExecutioner) {
+		<-ctx.Done()
+		close(stopped)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- client.Run(ctx) }()
+
+	// wait for Run to start before sending the job
+	for client.handlerContext() != ctx {
+		time.Sleep(time.Millisecond)
+	}
+	iot.deliver("$aws/things/thing/jobs/notify-next", map[string]interface{}{
+		"execution": map[string]interface{}{"jobId": "job1", "status": "QUEUED"},
+	})
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected clean shutdown, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return")
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Error("Run returned before the handler")
+	}
+}
+
+func TestJobRedeliveredAfterHandlerReturns(t *testing.T) {
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	calls := make(chan string, 2)
+	client.config.Handler = func(ctx context.Context, je JobExecutioner) {
+		calls <- je.GetJobID() // returns without a final status, as on an invalid job document
+	}
+	notify := map[string]interface{}{"execution": map[string]interface{}{"jobId": "job1", "status": "QUEUED"}}
+
+	iot.deliver("$aws/things/thing/jobs/notify-next", notify)
+	client.handlers.Wait()
+	if client.executions.len() != 0 {
+		t.Fatalf("expected the execution to be removed when the handler returns, got %d", client.executions.len())
+	}
+	iot.deliver("$aws/things/thing/jobs/notify-next", notify)
+	client.handlers.Wait()
+	if len(calls) != 2 {
+		t.Errorf("expected the job to be handled again, got %d calls", len(calls))
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	client.handlers.Add(1) // a handler which never returns
+	defer client.handlers.Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestConnectRetried(t *testing.T) {
+	defer func(delay time.Duration) { minConnectRetryDelay = delay }(minConnectRetryDelay)
+	minConnectRetryDelay = time.Millisecond
+	iot := newFakeMqtt()
+	iot.connectErrors = []error{errors.New("refused"), errors.New("refused")}
+	client := newTestClient(iot)
+
+	if err := client.connectWithRetry(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(iot.connectErrors) != 0 {
+		t.Errorf("expected all the failed attempts to be consumed, %d left", len(iot.connectErrors))
+	}
+
+	iot.connectErrors = []error{errors.New("refused")}
+	var connectError *ConnectError
+	if err := client.ConnectAndSubscribe(); !errors.As(err, &connectError) {
+		t.Errorf("expected a ConnectError, got %v", err)
+	}
+}
+
+func TestNewTLSConfigMissingFile(t *testing.T) {
+	_, err := NewTLSConfig("/nonexistent/rootCA.pem", "cert.pem", "private.key")
+	var credentialsError *CredentialsError
+	if !errors.As(err, &credentialsError) || credentialsError.Path != "/nonexistent/rootCA.pem" {
+		t.Errorf("expected a CredentialsError for the CA, got %v", err)
+	}
+}
+
+func TestReconfigureKeepsExecutions(t *testing.T) {
+	defer func(f func(Config, mqtt.ConnectionLostHandler) (IMqttClient, error)) { newMqttClient = f }(newMqttClient)
+	oldIot, newIot := newFakeMqtt(), newFakeMqtt()
+	newMqttClient = func(c Config, onLost mqtt.ConnectionLostHandler) (IMqttClient, error) { return newIot, nil }
+	client := newTestClient(oldIot)
+	je := &JobExecution{JobID: "job1", VersionNumber: 1, client: client}
+	client.executions.add(je)
+
+	if err := client.Reconfigure(Config{ThingName: "thing", Endpoint: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(oldIot.subscriptions) != 0 {
+		t.Errorf("expected the old client to be unsubscribed, got %d subscriptions", len(oldIot.subscriptions))
+	}
+	newIot.onPublish = func(topic string, payload []byte) {
+		if topic != "$aws/things/thing/jobs/job1/update" {
+			return
+		}
+		newIot.deliver(topic+"/accepted", map[string]interface{}{
+			"clientToken":    clientToken(payload),
+			"executionState": map[string]interface{}{"status": "IN_PROGRESS", "versionNumber": 2},
+		})
+	}
+	if err := je.InProgress(StatusDetails{"step": "installing"}); err != nil {
+		t.Fatal(err)
+	}
+	if je.VersionNumber != 2 {
+		t.Errorf("expected the update to go through the new connection, got version %d", je.VersionNumber)
+	}
+	if err := client.Reconfigure(Config{ThingName: "other"}); err == nil {
+		t.Error("expected an error changing ThingName with an execution in progress")
+	}
+}
+
+func TestReconfigureRestoresOnConnectError(t *testing.T) {
+	defer func(f func(Config, mqtt.ConnectionLostHandler) (IMqttClient, error)) { newMqttClient = f }(newMqttClient)
+	oldIot, newIot := newFakeMqtt(), newFakeMqtt()
+	newIot.connectErrors = []error{errors.New("refused")}
+	newMqttClient = func(c Config, onLost mqtt.ConnectionLostHandler) (IMqttClient, error) { return newIot, nil }
+	client := newTestClient(oldIot)
+
+	var connectError *ConnectError
+	if err := client.Reconfigure(Config{ThingName: "thing", Endpoint: "other"}); !errors.As(err, &connectError) {
+		t.Errorf("expected a ConnectError, got %v", err)
+	}
+	if client.iot() != oldIot || client.getConfig().Endpoint != "" {
+		t.Error("expected the previous configuration to be restored")
+	}
+	if len(oldIot.subscriptions) == 0 {
+		t.Error("expected the previous client to be subscribed again")
+	}
+}
+
+func TestConnectionLostResubscribes(t *testing.T) {
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	client.unsubscribe() // as after a new connection with a clean session
+	started := make(chan struct{}, 1)
+	iot.onPublish = func(topic string, payload []byte) {
+		if topic == "$aws/things/thing/jobs/start-next" {
+			started <- struct{}{}
+		}
+	}
+
+	client.connectionLost(nil, errors.New("EOF"))
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("expected the client to reconnect and check for jobs")
+	}
+	iot.mux.Lock()
+	defer iot.mux.Unlock()
+	if _, ok := iot.subscriptions["$aws/things/thing/jobs/notify-next"]; !ok {
+		t.Error("expected the job topics to be subscribed again")
+	}
+}
+
+func TestSubscribeTimeoutFailsConnection(t *testing.T) {
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	iot.noSuback = true
+	if err := client.ConnectAndSubscribe(); !errors.Is(err, errSubscribeTimeout) {
+		t.Fatalf("expected the missing SUBACK to fail the connection, got %v", err)
+	}
+	iot.mux.Lock()
+	defer iot.mux.Unlock()
+	for _, topic := range iot.published {
+		if topic == "$aws/things/thing/jobs/start-next" {
+			t.Error("expected no start-next without the job subscriptions")
+		}
+	}
+}
+
+func TestShutdownStopsReconnection(t *testing.T) {
+	defer func(d time.Duration) { minConnectRetryDelay = d }(minConnectRetryDelay)
+	minConnectRetryDelay = 50 * time.Millisecond
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	if err := client.ConnectAndSubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	iot.connectErrors = []error{errors.New("network down")}
+	client.stats.onConnectionLost(errors.New("EOF"))
+	reconnected := make(chan error)
+	go func() { reconnected <- client.connectWithRetry(client.startReconnect()) }()
+	for connects := 1; connects < 2; time.Sleep(time.Millisecond) {
+		iot.mux.Lock()
+		connects = iot.connects
+		iot.mux.Unlock()
+	}
+
+	if err := client.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-reconnected; err != context.Canceled {
+		t.Errorf("expected the reconnection to be cancelled, got %v", err)
+	}
+	if iot.connects != 2 || len(iot.subscriptions) != 0 {
+		t.Errorf("expected no reconnection after Shutdown, got %d connects and %d subscriptions", iot.connects, len(iot.subscriptions))
+	}
+	if client.startReconnect().Err() == nil {
+		t.Error("expected a connection loss after Shutdown not to reconnect")
+	}
+}
+
+func TestReconfigureStopsReconnection(t *testing.T) {
+	defer func(f func(Config, mqtt.ConnectionLostHandler) (IMqttClient, error)) { newMqttClient = f }(newMqttClient)
+	defer func(d time.Duration) { minConnectRetryDelay = d }(minConnectRetryDelay)
+	minConnectRetryDelay = 50 * time.Millisecond
+	old := newFakeMqtt()
+	client := newTestClient(old)
+	if err := client.ConnectAndSubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	old.connectErrors = []error{errors.New("network down"), errors.New("network down")}
+	client.stats.onConnectionLost(errors.New("EOF"))
+	reconnected := make(chan error)
+	go func() { reconnected <- client.connectWithRetry(client.startReconnect()) }()
+
+	iot := newFakeMqtt()
+	newMqttClient = func(c Config, onLost mqtt.ConnectionLostHandler) (IMqttClient, error) { return iot, nil }
+	if err := client.Reconfigure(client.getConfig()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second):
+		t.Fatal("expected Reconfigure to stop the reconnection")
+	}
+	iot.mux.Lock()
+	defer iot.mux.Unlock()
+	if iot.connects != 1 {
+		t.Errorf("expected the new client to be connected once, got %d connections", iot.connects)
+	}
+}
+
+func TestTLSClientReconnectsThroughConnectionLost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reconnect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client, _ := newWatchedClient(t, dir)
+	client.config.Endpoint = "example.com"
+	client.config.Port = 8883
+
+	iot, err := newMqttClient(client.config, client.connectionLost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With a clean session paho would reconnect without the subscriptions
+	if options := iot.(mqtt.Client).OptionsReader(); options.AutoReconnect() {
+		t.Error("expected paho not to reconnect automatically")
+	}
+}
+
+func TestResyncAfterReconnect(t *testing.T) {
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	running := &JobExecution{JobID: "job1", VersionNumber: 1, ExecutionNumber: 1, client: client}
+	cancelled := &JobExecution{JobID: "job2", VersionNumber: 1, ExecutionNumber: 1, client: client}
+	client.executions.add(running)
+	client.executions.add(cancelled)
+	iot.onPublish = func(topic string, payload []byte) {
+		if topic == "$aws/things/thing/jobs/get" {
+			iot.deliver(topic+"/accepted", map[string]interface{}{
+				"clientToken": clientToken(payload),
+				"inProgressJobs": []map[string]interface{}{
+					{"jobId": "job1", "versionNumber": 4, "executionNumber": 1},
+				},
+			})
+		}
+	}
+
+	client.resync(context.Background())
+	if running.VersionNumber != 4 {
+		t.Errorf("expected the version of job1 to be refreshed, got %d", running.VersionNumber)
+	}
+	if cancelled.VersionNumber != 1 {
+		t.Errorf("expected job2 to be left alone, got version %d", cancelled.VersionNumber)
+	}
+}
@@ -0,0 +1,152 @@
+package awsiotjobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// defaultCertificateCheckInterval is the default of Config.CertificateCheckInterval
+const defaultCertificateCheckInterval = time.Minute
+
+// rotationRetryDelay is how long the watcher waits before trying again credentials which failed to connect,
+// in case the failure was due to the network rather than to the credentials
+var rotationRetryDelay = time.Hour
+
+// credentials identifies the content of the CA, certificate and private key files
+type credentials struct {
+	paths [3]string
+	sum   [sha256.Size]byte
+}
+
+// readCredentials returns the fingerprint of the credential files of c, or a *CredentialsError
+func readCredentials(c Config) (credentials, error) {
+	creds := credentials{paths: [3]string{c.CaCertPath}}
+	if c.Transport != transportWebSocket {
+		creds.paths[1] = c.CertificatePath
+		keys, _ := newKeyProvider(c)
+		if _, isFile := keys.(FileKey); isFile {
+			creds.paths[2] = c.PrivateKeyPath // the other providers do not keep the key in a file
+		}
+	}
+	h := sha256.New()
+	for _, path := range creds.paths {
+		if len(path) == 0 {
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return creds, &CredentialsError{path, err}
+		}
+		h.Write(b)
+	}
+	copy(creds.sum[:], h.Sum(nil))
+	return creds, nil
+}
+
+// validateCredentials checks that the files of c form a usable TLS configuration: the certificate matches
+// the private key and is currently valid
+func validateCredentials(c Config) error {
+	tlsConfig, err := newTLSConfig(c)
+	if err != nil {
+		return err
+	}
+	if len(tlsConfig.Certificates) == 0 {
+		return nil // the WebSocket transport has no certificate
+	}
+	leaf := tlsConfig.Certificates[0].Leaf
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return &CredentialsError{c.CertificatePath, fmt.Errorf("certificate valid from %s to %s",
+			leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))}
+	}
+	return nil
+}
+
+func (client *Client) getCredentials() credentials {
+	client.mux.Lock()
+	defer client.mux.Unlock()
+	return client.credentials
+}
+
+func (client *Client) setCredentials(creds credentials, cert *x509.Certificate) {
+	client.mux.Lock()
+	defer client.mux.Unlock()
+	client.credentials = creds
+	client.certificate = cert
+}
+
+// refreshCredentials replaces the MQTT client, which is not connected, when the credential files have changed
+// and form a valid pair, so that the next connection attempt uses them. This recovers a device which cannot
+// connect because its certificate expired or was revoked. It must be called holding client.reconfigure.
+func (client *Client) refreshCredentials() bool {
+	c := client.getConfig()
+	creds, err := readCredentials(c)
+	if err != nil || creds == client.getCredentials() {
+		return false
+	}
+	if err := validateCredentials(c); err != nil {
+		client.Logger().Debug("Certificate check - Ignoring the new credentials", F("error", err))
+		return false
+	}
+	iot, err := newMqttClient(c, client.connectionLost)
+	if err != nil {
+		client.Logger().Warn("Certificate check - Cannot use the new credentials", F("error", err))
+		return false
+	}
+	client.Logger().Info("Certificate check - Credentials changed, connecting with them")
+	client.setConfig(c, iot)
+	client.setCredentials(creds, usedCertificate(c))
+	return true
+}
+
+/*
+watchCredentials checks every Config.CertificateCheckInterval whether the CA, certificate or private key files
+have changed, for example because the provisioning service rotated the certificate, until ctx is done.
+Files which do not form a valid pair yet, like a certificate written before its key, are ignored until the
+next change. While connected, valid ones are applied with Reconfigure, which goes back to the previous
+credentials if the connection fails: those are then tried again only after rotationRetryDelay, or when the
+files change again. While disconnected, the next connection attempt uses them, see refreshCredentials.
+*/
+func (client *Client) watchCredentials(ctx context.Context) {
+	var failed credentials
+	var failedAt time.Time
+	for {
+		interval := time.Duration(client.getConfig().CertificateCheckInterval)
+		if interval <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		if !client.stats.isConnected() {
+			client.reconfigure.Lock()
+			client.refreshCredentials()
+			client.reconfigure.Unlock()
+			continue
+		}
+		c := client.getConfig()
+		creds, err := readCredentials(c)
+		if err != nil {
+			client.Logger().Warn("Certificate check - Cannot read the credentials", F("error", err))
+			continue
+		}
+		if creds == client.getCredentials() || (creds == failed && time.Since(failedAt) < rotationRetryDelay) {
+			continue
+		}
+		if err := validateCredentials(c); err != nil {
+			client.Logger().Warn("Certificate check - Ignoring the new credentials", F("error", err))
+			continue
+		}
+		client.Logger().Info("Certificate check - Credentials changed, reconnecting")
+		if err := client.Reconfigure(c); err != nil {
+			client.Logger().Error("Certificate check - Cannot connect with the new credentials", F("error", err))
+			failed, failedAt = creds, time.Now()
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package awsiotjobs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// writeCertificate writes a self-signed certificate valid until notAfter and its private key in dir
+func writeCertificate(t *testing.T, dir string, notAfter time.Time) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "thing"},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath = writeTempFile(t, dir, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyPath = writeTempFile(t, dir, "private.key", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})))
+	return certPath, keyPath
+}
+
+func newWatchedClient(t *testing.T, dir string) (*Client, *fakeMqtt) {
+	certPath, keyPath := writeCertificate(t, dir, time.Now().Add(time.Hour))
+	ca, _ := ioutil.ReadFile(certPath)
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	client.config.CaCertPath = writeTempFile(t, dir, "rootCA.pem", string(ca))
+	client.config.CertificatePath = certPath
+	client.config.PrivateKeyPath = keyPath
+	client.config.CertificateCheckInterval = Duration(time.Millisecond)
+	client.credentials, _ = readCredentials(client.config)
+	return client, iot
+}
+
+func TestCredentialsRotation(t *testing.T) {
+	defer func(f func(Config, mqtt.ConnectionLostHandler) (IMqttClient, error)) { newMqttClient = f }(newMqttClient)
+	dir, err := ioutil.TempDir("", "certwatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client, oldIot := newWatchedClient(t, dir)
+	if err := client.ConnectAndSubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	newIot := newFakeMqtt()
+	newMqttClient = func(c Config, onLost mqtt.ConnectionLostHandler) (IMqttClient, error) { return newIot, nil }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.watchCredentials(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// A certificate without the matching key must be ignored
+	other := filepath.Join(dir, "other")
+	os.Mkdir(other, 0700)
+	cert, _ := writeCertificate(t, other, time.Now().Add(time.Hour))
+	os.Rename(cert, client.config.CertificatePath)
+	time.Sleep(20 * time.Millisecond)
+	if client.iot() != oldIot {
+		t.Fatal("expected a mismatched certificate and key to be ignored")
+	}
+
+	writeCertificate(t, dir, time.Now().Add(time.Hour))
+	for deadline := time.Now().Add(time.Second); client.iot() != newIot; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the client to reconnect with the new certificate")
+		}
+	}
+}
+
+func TestExpiredCertificateRotatedBeforeConnecting(t *testing.T) {
+	defer func(f func(Config, mqtt.ConnectionLostHandler) (IMqttClient, error)) { newMqttClient = f }(newMqttClient)
+	defer func(d time.Duration) { minConnectRetryDelay = d }(minConnectRetryDelay)
+	minConnectRetryDelay = time.Millisecond
+	dir, err := ioutil.TempDir("", "certwatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client, expiredIot := newWatchedClient(t, dir)
+	writeCertificate(t, dir, time.Now().Add(-time.Hour))
+	client.credentials, _ = readCredentials(client.config)
+	client.config.CertificateCheckInterval = Duration(time.Hour) // only the connection attempts check the files
+	refused := errors.New("certificate expired")
+	expiredIot.connectErrors = []error{refused, refused, refused, refused, refused, refused, refused, refused}
+	rotatedIot := newFakeMqtt()
+	newMqttClient = func(c Config, onLost mqtt.ConnectionLostHandler) (IMqttClient, error) { return rotatedIot, nil }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connected := make(chan error)
+	go func() { connected <- client.connectWithRetry(ctx) }()
+	writeCertificate(t, dir, time.Now().Add(time.Hour))
+	select {
+	case err := <-connected:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the client to connect with the rotated certificate")
+	}
+	if client.iot() != rotatedIot {
+		t.Error("expected the MQTT client to be rebuilt with the rotated certificate")
+	}
+}
+
+func TestValidateCredentialsExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certwatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client, _ := newWatchedClient(t, dir)
+	if err := validateCredentials(client.config); err != nil {
+		t.Fatal(err)
+	}
+
+	writeCertificate(t, dir, time.Now().Add(-time.Hour))
+	var credentialsError *CredentialsError
+	if err := validateCredentials(client.config); !errors.As(err, &credentialsError) {
+		t.Errorf("expected a CredentialsError for the expired certificate, got %v", err)
+	}
+}
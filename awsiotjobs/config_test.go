@@ -0,0 +1,170 @@
+package awsiotjobs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTempFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	c := Config{
+		Port:      0,
+		Endpoint:  "<ENDPOINT>",
+		ThingName: "my thing",
+	}
+	err := c.Validate()
+	var validationError *ValidationError
+	if !errors.As(err, &validationError) {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+	for _, field := range []string{"Endpoint", "Port", "ThingName", "ClientID", "CaCertPath", "CertificatePath", "PrivateKeyPath"} {
+		found := false
+		for _, problem := range validationError.Problems {
+			if strings.HasPrefix(problem, field) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected a problem for %s in %v", field, validationError.Problems)
+		}
+	}
+}
+
+func TestValidateOK(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := Config{
+		Port:            8883,
+		CaCertPath:      writeTempFile(t, dir, "rootCA.pem", ""),
+		CertificatePath: writeTempFile(t, dir, "cert.pem", ""),
+		PrivateKeyPath:  writeTempFile(t, dir, "private.key", ""),
+		Endpoint:        "abc-ats.iot.eu-west-1.amazonaws.com",
+		ThingName:       "thing_1",
+		ClientID:        "thing_1",
+	}
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFromFileRejectsUnknownKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeTempFile(t, dir, "goagent.conf", `{"Port": 443, "thingId": "thing"}`)
+
+	c := NewConfig()
+	err = c.FromFile(path)
+	if err == nil || !strings.Contains(err.Error(), "thingId") {
+		t.Errorf("expected an error for the unknown key, got %v", err)
+	}
+}
+
+func TestFromFileFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"goagent.json": `{"Port": 443, "ThingName": "thing", "ShutdownTimeout": "10s"}`,
+		"goagent.yaml": "Port: 443\nThingName: thing\nShutdownTimeout: 10s\n",
+		"goagent.yml":  "port: 443\nthingName: thing\nshutdownTimeout: 10s\n",
+		"goagent.toml": "Port = 443\nThingName = \"thing\"\nShutdownTimeout = \"10s\"\n",
+	}
+	for name, content := range files {
+		c := NewConfig()
+		if err := c.FromFile(writeTempFile(t, dir, name, content)); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if c.Port != 443 || c.ThingName != "thing" || time.Duration(c.ShutdownTimeout) != 10*time.Second {
+			t.Errorf("%s: unexpected configuration %+v", name, c)
+		}
+	}
+}
+
+func TestFromFileNestedSections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"goagent.yaml": `PKCS11:
+  ModulePath: /usr/lib/softhsm/libsofthsm2.so
+  TokenLabel: goagent
+AWS:
+  Region: eu-west-1
+Provisioning:
+  TemplateName: fleet
+  Parameters:
+    SerialNumber: "1234"
+`,
+		"goagent.toml": `[PKCS11]
+ModulePath = "/usr/lib/softhsm/libsofthsm2.so"
+TokenLabel = "goagent"
+
+[AWS]
+Region = "eu-west-1"
+
+[Provisioning]
+TemplateName = "fleet"
+
+[Provisioning.Parameters]
+SerialNumber = "1234"
+`,
+	}
+	for name, content := range files {
+		c := NewConfig()
+		if err := c.FromFile(writeTempFile(t, dir, name, content)); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if c.PKCS11.ModulePath != "/usr/lib/softhsm/libsofthsm2.so" || c.PKCS11.TokenLabel != "goagent" {
+			t.Errorf("%s: unexpected PKCS11 section %+v", name, c.PKCS11)
+		}
+		if c.AWS.Region != "eu-west-1" {
+			t.Errorf("%s: unexpected AWS section %+v", name, c.AWS)
+		}
+		if c.Provisioning.TemplateName != "fleet" || c.Provisioning.Parameters["SerialNumber"] != "1234" {
+			t.Errorf("%s: unexpected Provisioning section %+v", name, c.Provisioning)
+		}
+	}
+}
+
+func TestFromFileFormatsRejectUnknownKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"goagent.yaml": "Port: 443\nthingId: thing\n",
+		"goagent.toml": "Port = 443\nthingId = \"thing\"\n",
+	}
+	for name, content := range files {
+		c := NewConfig()
+		err := c.FromFile(writeTempFile(t, dir, name, content))
+		if err == nil || !strings.Contains(err.Error(), "thingId") {
+			t.Errorf("%s: expected an error for the unknown key, got %v", name, err)
+		}
+	}
+}
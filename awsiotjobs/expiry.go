@@ -0,0 +1,142 @@
+package awsiotjobs
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// defaultCertificateExpiryWarning is the default of Config.CertificateExpiryWarning
+const defaultCertificateExpiryWarning = 30 * 24 * time.Hour
+
+// expiryCheckInterval is how often monitorExpiry checks the certificate in use
+var expiryCheckInterval = 12 * time.Hour
+
+// ExpiryReport is published on Config.CertificateReportTopic to let the fleet back end schedule
+// the rotation of the device certificates
+type ExpiryReport struct {
+	ThingName    string    `json:"thingName"`
+	SerialNumber string    `json:"serialNumber"`
+	Subject      string    `json:"subject"`
+	Issuer       string    `json:"issuer"`
+	NotBefore    time.Time `json:"notBefore"`
+	NotAfter     time.Time `json:"notAfter"`
+	// ExpiresIn is the number of seconds until NotAfter, negative once the certificate has expired
+	ExpiresIn int64 `json:"expiresIn"`
+	// Expiring is set when NotAfter is within Config.CertificateExpiryWarning
+	Expiring  bool  `json:"expiring"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+// loadCertificate reads the first certificate of the PEM file at path
+func loadCertificate(path string) (*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, &CredentialsError{path, err}
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, &CredentialsError{path, errors.New("no PEM certificate found")}
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, &CredentialsError{path, err}
+	}
+	return cert, nil
+}
+
+// usedCertificate returns the device certificate of c, or nil with the WebSocket transport which does not use it
+func usedCertificate(c Config) *x509.Certificate {
+	if c.Transport == transportWebSocket {
+		return nil
+	}
+	cert, _ := loadCertificate(c.CertificatePath)
+	return cert
+}
+
+func newExpiryReport(c Config, cert *x509.Certificate, now time.Time) ExpiryReport {
+	expiresIn := cert.NotAfter.Sub(now)
+	return ExpiryReport{
+		ThingName:    c.ThingName,
+		SerialNumber: fmt.Sprintf("%x", cert.SerialNumber),
+		Subject:      cert.Subject.String(),
+		Issuer:       cert.Issuer.String(),
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+		ExpiresIn:    int64(expiresIn / time.Second),
+		Expiring:     expiresIn < time.Duration(c.CertificateExpiryWarning),
+		Timestamp:    now.Unix(),
+	}
+}
+
+func (client *Client) getCertificate() *x509.Certificate {
+	client.mux.Lock()
+	defer client.mux.Unlock()
+	return client.certificate
+}
+
+// expiryReport returns the report of the certificate in use, false with the WebSocket transport
+func (client *Client) expiryReport() (ExpiryReport, bool) {
+	cert := client.getCertificate()
+	if cert == nil {
+		return ExpiryReport{}, false
+	}
+	return newExpiryReport(client.getConfig(), cert, time.Now()), true
+}
+
+// logExpiry logs an error when the certificate has expired and a warning when it expires within
+// Config.CertificateExpiryWarning
+func (client *Client) logExpiry(report ExpiryReport) {
+	notAfter := report.NotAfter.Format(time.RFC3339)
+	switch {
+	case report.ExpiresIn < 0:
+		client.Logger().Error("Certificate check - Certificate expired", F("serialNumber", report.SerialNumber), F("notAfter", notAfter))
+	case report.Expiring:
+		client.Logger().Warn("Certificate check - Certificate expiring", F("serialNumber", report.SerialNumber),
+			F("notAfter", notAfter), F("expiresIn", time.Duration(report.ExpiresIn)*time.Second))
+	}
+}
+
+// publishExpiry publishes the report on Config.CertificateReportTopic, if set
+func (client *Client) publishExpiry(report ExpiryReport) {
+	topic := client.getConfig().CertificateReportTopic
+	if len(topic) == 0 {
+		return
+	}
+	payload, err := json.Marshal(report)
+	if err != nil {
+		client.Logger().Error("Certificate check - Cannot encode the expiry report", F("error", err))
+		return
+	}
+	client.mqttPublish(topic, 1, payload)
+}
+
+// checkExpiry logs the expiry of the certificate in use and publishes an ExpiryReport, see logExpiry and
+// publishExpiry
+func (client *Client) checkExpiry() {
+	if report, ok := client.expiryReport(); ok {
+		client.logExpiry(report)
+		client.publishExpiry(report)
+	}
+}
+
+// monitorExpiry publishes the report once connected, the expiry having been logged by Run before connecting,
+// then calls checkExpiry every expiryCheckInterval until ctx is done
+func (client *Client) monitorExpiry(ctx context.Context) {
+	if report, ok := client.expiryReport(); ok {
+		client.publishExpiry(report)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(expiryCheckInterval):
+		}
+		client.checkExpiry()
+	}
+}
@@ -0,0 +1,118 @@
+package awsiotjobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckExpiryPublishesReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "expiry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, _ := writeCertificate(t, dir, time.Now().Add(24*time.Hour))
+	cert, err := loadCertificate(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	client.certificate = cert
+	client.config.CertificateExpiryWarning = Duration(48 * time.Hour)
+	client.config.CertificateReportTopic = "fleet/certificates"
+	reports := make(chan ExpiryReport, 1)
+	iot.onPublish = func(topic string, payload []byte) {
+		if topic != "fleet/certificates" {
+			return
+		}
+		var report ExpiryReport
+		if err := json.Unmarshal(payload, &report); err != nil {
+			t.Error(err)
+		}
+		reports <- report
+	}
+
+	client.checkExpiry()
+	select {
+	case report := <-reports:
+		if report.ThingName != "thing" || !report.Expiring || !report.NotAfter.Equal(cert.NotAfter) {
+			t.Errorf("unexpected report %+v", report)
+		}
+		if report.ExpiresIn <= 23*3600 || report.ExpiresIn > 24*3600 {
+			t.Errorf("expected the certificate to expire in a day, got %ds", report.ExpiresIn)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected an expiry report")
+	}
+}
+
+func TestExpiryReportWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "expiry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, _ := writeCertificate(t, dir, time.Now().Add(90*24*time.Hour))
+	cert, err := loadCertificate(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{CertificateExpiryWarning: Duration(defaultCertificateExpiryWarning)}
+	if report := newExpiryReport(c, cert, time.Now()); report.Expiring {
+		t.Error("expected a certificate valid for 90 days not to be expiring")
+	}
+	if report := newExpiryReport(c, cert, time.Now().Add(75*24*time.Hour)); !report.Expiring {
+		t.Error("expected a certificate valid for 15 days to be expiring")
+	}
+	if report := newExpiryReport(c, cert, time.Now().Add(100*24*time.Hour)); report.ExpiresIn >= 0 {
+		t.Errorf("expected a negative ExpiresIn for an expired certificate, got %d", report.ExpiresIn)
+	}
+}
+
+func TestExpiredCertificateLoggedBeforeConnecting(t *testing.T) {
+	defer func(d time.Duration) { minConnectRetryDelay = d }(minConnectRetryDelay)
+	minConnectRetryDelay = time.Millisecond
+	dir, err := ioutil.TempDir("", "expiry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client, iot := newWatchedClient(t, dir)
+	certPath, _ := writeCertificate(t, dir, time.Now().Add(-time.Hour))
+	if client.certificate, err = loadCertificate(certPath); err != nil {
+		t.Fatal(err)
+	}
+	client.credentials, _ = readCredentials(client.config)
+	var logs bytes.Buffer
+	client.logger = newBufferLogger(&logs, logFormatText, LevelInfo)
+	iot.connectErrors = []error{errors.New("certificate expired")}
+	iot.noSuback = true // the connection never completes
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- client.Run(ctx) }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		iot.mux.Lock()
+		connects := iot.connects
+		iot.mux.Unlock()
+		if connects > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected a connection attempt")
+		}
+	}
+	cancel()
+	<-done
+	if !strings.Contains(logs.String(), "ERROR Certificate check - Certificate expired") {
+		t.Errorf("expected the expired certificate to be logged before connecting, got %s", logs.String())
+	}
+}
@@ -0,0 +1,121 @@
+package awsiotjobs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// journalEntry is the local record of the last status transition of a job execution.
+// It is written before the corresponding update is sent to AWS IoT, so after a crash or a
+// reboot the device knows the last state it tried to report even if the update never made it.
+type journalEntry struct {
+	JobID           string        `json:"jobId"`
+	ExecutionNumber int64         `json:"executionNumber"`
+	Status          string        `json:"status"`
+	StatusDetails   StatusDetails `json:"statusDetails"`
+	UpdatedAt       int64         `json:"updatedAt"`
+}
+
+// journal persists one journalEntry per job in a directory.
+// A nil journal is valid and does nothing, which is what you get when no StateDir is configured.
+type journal struct {
+	dir string
+}
+
+func newJournal(dir string) *journal {
+	if len(dir) == 0 {
+		return nil
+	}
+	return &journal{dir: dir}
+}
+
+func (j *journal) path(jobID string) string {
+	return filepath.Join(j.dir, jobID+".json")
+}
+
+func (j *journal) write(e journalEntry) error {
+	if j == nil {
+		return nil
+	}
+	e.UpdatedAt = time.Now().Unix()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(j.dir, 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(j.path(e.JobID), data, 0600)
+}
+
+// read returns the entry for jobID, or nil if the job has never been journaled
+func (j *journal) read(jobID string) (*journalEntry, error) {
+	if j == nil {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(j.path(jobID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var e journalEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (j *journal) remove(jobID string) error {
+	if j == nil {
+		return nil
+	}
+	err := os.Remove(j.path(jobID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// writeFileAtomic replaces the content of path so that, even if power is lost, the file
+// contains either the old or the new data. The data is written to a temporary file in the
+// same directory, synced, and renamed over the target; the directory is then synced so the
+// rename itself is durable.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // no-op once renamed
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
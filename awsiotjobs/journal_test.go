@@ -0,0 +1,74 @@
+package awsiotjobs
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestJournalWriteRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j := newJournal(dir)
+	entry := journalEntry{
+		JobID:           "job",
+		ExecutionNumber: 2,
+		Status:          "IN_PROGRESS",
+		StatusDetails:   StatusDetails{"step": "rebooting"},
+	}
+	if err := j.write(entry); err != nil {
+		t.Fatal(err)
+	}
+	got, err := j.read("job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Status != entry.Status || got.ExecutionNumber != entry.ExecutionNumber ||
+		!reflect.DeepEqual(got.StatusDetails, entry.StatusDetails) {
+		t.Errorf("\nwanted: %v,\ngot     %v", entry, got)
+	}
+
+	if err := j.remove("job"); err != nil {
+		t.Fatal(err)
+	}
+	got, err = j.read("job")
+	if err != nil || got != nil {
+		t.Errorf("expected no entry after remove, got %v, %v", got, err)
+	}
+}
+
+func TestJournalDisabled(t *testing.T) {
+	j := newJournal("")
+	if err := j.write(journalEntry{JobID: "job"}); err != nil {
+		t.Errorf("write on disabled journal returned %v", err)
+	}
+	got, err := j.read("job")
+	if got != nil || err != nil {
+		t.Errorf("read on disabled journal returned %v, %v", got, err)
+	}
+}
+
+func TestLoadLocalStateDiscardsOtherExecutions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := &Client{journal: newJournal(dir)}
+	client.journal.write(journalEntry{JobID: "job", ExecutionNumber: 1, Status: "IN_PROGRESS"})
+
+	je := &JobExecution{JobID: "job", ExecutionNumber: 2, client: client}
+	je.loadLocalState()
+	if je.GetLocalStatusDetails() != nil || je.local != nil {
+		t.Errorf("expected stale entry to be discarded, got %v", je.local)
+	}
+	if _, err := os.Stat(client.journal.path("job")); !os.IsNotExist(err) {
+		t.Errorf("expected stale journal file to be removed, got %v", err)
+	}
+}
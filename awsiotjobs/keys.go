@@ -0,0 +1,174 @@
+package awsiotjobs
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// KeyProvider gives access to the private key of the device certificate. The key does not need to be
+// readable: with a secure element the provider returns a crypto.Signer which signs on the device.
+type KeyProvider interface {
+	// Signer returns the private key of cert, or a *CredentialsError
+	Signer(cert *x509.Certificate) (crypto.Signer, error)
+}
+
+// FileKey is a KeyProvider reading the private key from a PEM file, in PKCS #1, PKCS #8 or SEC 1 format
+type FileKey string
+
+// Signer reads and parses the key file
+func (path FileKey) Signer(cert *x509.Certificate) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(string(path))
+	if err != nil {
+		return nil, &CredentialsError{string(path), err}
+	}
+	for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			signer, err := parsePrivateKey(block.Bytes)
+			if err != nil {
+				return nil, &CredentialsError{string(path), err}
+			}
+			return signer, nil
+		}
+	}
+	return nil, &CredentialsError{string(path), errors.New("no PEM private key found")}
+}
+
+// parsePrivateKey parses the DER private key, trying the same formats as tls.X509KeyPair
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("cannot parse the private key")
+}
+
+// newKeyProvider returns the KeyProvider selected by c.KeyProvider
+func newKeyProvider(c Config) (KeyProvider, error) {
+	switch c.KeyProvider {
+	case "", "file":
+		return FileKey(c.PrivateKeyPath), nil
+	case "pkcs11":
+		return c.PKCS11, nil
+	default:
+		return nil, fmt.Errorf("awsiotjobs: unknown KeyProvider \"%s\"", c.KeyProvider)
+	}
+}
+
+// alpnMQTT is the ALPN protocol telling AWS IoT that a connection on port 443 is MQTT with a client certificate
+const alpnMQTT = "x-amzn-mqtt-ca"
+
+// newTLSConfig creates the TLS config for c, with the private key from the KeyProvider it selects.
+// The WebSocket transport is authenticated by the signed URL and does not use the certificate.
+// On port 443, which AWS IoT shares between MQTT and HTTPS, the MQTT connections are announced with ALPN.
+func newTLSConfig(c Config) (*tls.Config, error) {
+	if c.Transport == transportWebSocket {
+		certpool, err := loadCertPool(c.CaCertPath)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{RootCAs: certpool}, nil
+	}
+	keys, err := newKeyProvider(c)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := NewTLSConfigWithKey(c.CaCertPath, c.CertificatePath, keys)
+	if err != nil {
+		return nil, err
+	}
+	if c.Port == 443 {
+		tlsConfig.NextProtos = []string{alpnMQTT}
+	}
+	return tlsConfig, nil
+}
+
+// loadCertPool reads the CA certificates of the PEM file at path
+func loadCertPool(path string) (*x509.CertPool, error) {
+	certpool := x509.NewCertPool()
+	caCert, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, &CredentialsError{path, err}
+	}
+	if !certpool.AppendCertsFromPEM(caCert) {
+		return nil, &CredentialsError{path, errors.New("no PEM certificate found")}
+	}
+	return certpool, nil
+}
+
+// NewTLSConfigWithKey creates a new TLS config like NewTLSConfig, getting the private key from keys.
+// It returns a *CredentialsError if the files cannot be loaded or if the key does not match the certificate.
+func NewTLSConfigWithKey(caCertPath, certPath string, keys KeyProvider) (*tls.Config, error) {
+	certpool, err := loadCertPool(caCertPath)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, &CredentialsError{certPath, err}
+	}
+	var cert tls.Certificate
+	for block, rest := pem.Decode(certPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, &CredentialsError{certPath, errors.New("no PEM certificate found")}
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, &CredentialsError{certPath, err}
+	}
+
+	signer, err := keys.Signer(cert.Leaf)
+	if err != nil {
+		return nil, err
+	}
+	public, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !public.Equal(cert.Leaf.PublicKey) {
+		return nil, &CredentialsError{certPath, errors.New("the private key does not match the certificate")}
+	}
+	cert.PrivateKey = signer
+
+	return &tls.Config{
+		RootCAs:            certpool,
+		ClientAuth:         tls.NoClientCert,
+		ClientCAs:          nil,
+		InsecureSkipVerify: false,
+		Certificates:       []tls.Certificate{cert},
+	}, nil
+}
+
+// uri identifies the key in the errors, in the format of RFC 7512
+func (p PKCS11Config) uri() string {
+	uri := "pkcs11:"
+	if len(p.TokenLabel) > 0 {
+		uri += "token=" + url.PathEscape(p.TokenLabel) + ";"
+	}
+	if len(p.TokenSerial) > 0 {
+		uri += "serial=" + url.PathEscape(p.TokenSerial) + ";"
+	}
+	if len(p.KeyLabel) > 0 {
+		uri += "object=" + url.PathEscape(p.KeyLabel) + ";"
+	}
+	if len(p.KeyID) > 0 {
+		uri += "id=" + p.KeyID + ";"
+	}
+	return strings.TrimSuffix(uri, ";")
+}
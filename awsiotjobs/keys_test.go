@@ -0,0 +1,96 @@
+package awsiotjobs
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signerKey is a KeyProvider returning a key held in memory, like a secure element would
+type signerKey struct {
+	signer crypto.Signer
+}
+
+func (k signerKey) Signer(cert *x509.Certificate) (crypto.Signer, error) {
+	return k.signer, nil
+}
+
+func TestNewTLSConfigWithKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeCertificate(t, dir, time.Now().Add(time.Hour))
+	signer, err := FileKey(keyPath).Signer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlsConfig, err := NewTLSConfigWithKey(certPath, certPath, signerKey{signer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.Certificates[0].PrivateKey != signer || tlsConfig.Certificates[0].Leaf == nil {
+		t.Error("expected the certificate to use the provided signer")
+	}
+
+	other := filepath.Join(dir, "other")
+	os.Mkdir(other, 0700)
+	_, otherKeyPath := writeCertificate(t, other, time.Now().Add(time.Hour))
+	var credentialsError *CredentialsError
+	if _, err := NewTLSConfig(certPath, certPath, otherKeyPath); !errors.As(err, &credentialsError) || credentialsError.Path != certPath {
+		t.Errorf("expected a CredentialsError for the mismatched key, got %v", err)
+	}
+}
+
+func TestValidateKeyProvider(t *testing.T) {
+	c := NewConfig()
+	c.KeyProvider = "pkcs11"
+	c.PKCS11 = PKCS11Config{ModulePath: "/nonexistent/libsofthsm2.so", KeyID: "xyz"}
+	var validationError *ValidationError
+	if err := c.Validate(); !errors.As(err, &validationError) {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+	problems := strings.Join(validationError.Problems, "\n")
+	for _, p := range []string{"PKCS11.ModulePath", "PKCS11.TokenLabel or PKCS11.TokenSerial", "PKCS11.KeyID must be hexadecimal"} {
+		if !strings.Contains(problems, p) {
+			t.Errorf("expected a problem about %s in:\n%s", p, problems)
+		}
+	}
+	if strings.Contains(problems, "PrivateKeyPath") {
+		t.Errorf("expected PrivateKeyPath to be ignored with PKCS#11, got:\n%s", problems)
+	}
+}
+
+func TestNewTLSConfigALPN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeCertificate(t, dir, time.Now().Add(time.Hour))
+	c := Config{Port: 443, CaCertPath: certPath, CertificatePath: certPath, PrivateKeyPath: keyPath}
+
+	tlsConfig, err := newTLSConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tlsConfig.NextProtos) != 1 || tlsConfig.NextProtos[0] != "x-amzn-mqtt-ca" {
+		t.Errorf("expected the x-amzn-mqtt-ca ALPN protocol on port 443, got %v", tlsConfig.NextProtos)
+	}
+
+	c.Port = 8883
+	if tlsConfig, err = newTLSConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if len(tlsConfig.NextProtos) != 0 {
+		t.Errorf("expected no ALPN protocol on port 8883, got %v", tlsConfig.NextProtos)
+	}
+}
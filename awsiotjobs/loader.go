@@ -0,0 +1,346 @@
+package awsiotjobs
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ConfigLoader builds the configuration from several layers, each one overriding the previous ones:
+// the defaults, the configuration file, the drop-in files, the environment and finally the overrides,
+// typically coming from the command line.
+//
+//	loader := awsiotjobs.ConfigLoader{
+//		Defaults:  awsiotjobs.NewConfig(),
+//		File:      "/etc/goagent/goagent.conf",
+//		DropInDir: "/etc/goagent/conf.d",
+//		Environ:   os.Environ(),
+//		EnvPrefix: "GOAGENT_",
+//	}
+//	config, provenance, err := loader.Load()
+type ConfigLoader struct {
+	// Defaults is the first layer, usually NewConfig()
+	Defaults Config
+	// File is the main configuration file. It is skipped if it does not exist, unless FileRequired is set.
+	File         string
+	FileRequired bool
+	// DropInDir contains configuration files applied in lexical order after File, for example
+	// conf.d/10-site.json then conf.d/20-device.yaml. Each drop-in only overrides the keys it contains.
+	// Files with an extension other than .json, .yaml, .yml and .toml are ignored.
+	DropInDir string
+	// Environ is the environment as returned by os.Environ. A variable made of EnvPrefix followed by the
+	// name of a setting in upper snake case overrides it, e.g. GOAGENT_THING_NAME or GOAGENT_CA_CERT_PATH.
+	// Variables with the prefix which do not match any setting are reported as an error.
+	Environ   []string
+	EnvPrefix string
+	overrides []override
+}
+
+type override struct {
+	key, value, source string
+}
+
+// Provenance maps every setting which is not a default to the layer which set it last,
+// for example "file /etc/goagent/goagent.conf" or "env GOAGENT_PORT"
+type Provenance map[string]string
+
+// Override sets the setting named key, e.g. "ThingName", after all the other layers.
+// source describes where the value comes from, like "flag -thingName".
+func (l *ConfigLoader) Override(key, value, source string) {
+	l.overrides = append(l.overrides, override{key, value, source})
+}
+
+// Load applies all the layers and returns the resulting configuration together with the provenance
+// of each setting. The configuration is not validated.
+func (l *ConfigLoader) Load() (Config, Provenance, error) {
+	c := l.Defaults
+	provenance := Provenance{}
+
+	files := []string{}
+	if len(l.File) > 0 {
+		if _, err := os.Stat(l.File); err == nil || l.FileRequired {
+			files = append(files, l.File)
+		}
+	}
+	if len(l.DropInDir) > 0 {
+		dropIns, err := dropInFiles(l.DropInDir)
+		if err != nil {
+			return c, provenance, err
+		}
+		files = append(files, dropIns...)
+	}
+	for _, file := range files {
+		if err := c.FromFile(file); err != nil {
+			return c, provenance, err
+		}
+		keys, err := fileKeys(file)
+		if err != nil {
+			return c, provenance, err
+		}
+		for _, key := range keys {
+			provenance[key] = "file " + file
+		}
+	}
+
+	if len(l.EnvPrefix) > 0 {
+		if err := l.applyEnv(&c, provenance); err != nil {
+			return c, provenance, err
+		}
+	}
+
+	for _, o := range l.overrides {
+		s, ok := findSetting(&c, o.key)
+		if !ok {
+			return c, provenance, fmt.Errorf("%s: unknown setting %s", o.source, o.key)
+		}
+		if err := setFromString(s.value, o.value); err != nil {
+			return c, provenance, fmt.Errorf("%s: %w", o.source, err)
+		}
+		provenance[s.key] = o.source
+	}
+	return c, provenance, nil
+}
+
+func (l *ConfigLoader) applyEnv(c *Config, provenance Provenance) error {
+	byEnv := make(map[string]setting)
+	for _, s := range settings(c) {
+		byEnv[l.EnvPrefix+s.env] = s
+	}
+	for _, kv := range l.Environ {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv[:i], l.EnvPrefix) {
+			continue
+		}
+		name, value := kv[:i], kv[i+1:]
+		s, ok := byEnv[name]
+		if !ok {
+			return fmt.Errorf("env %s: unknown setting", name)
+		}
+		if err := setFromString(s.value, value); err != nil {
+			return fmt.Errorf("env %s: %w", name, err)
+		}
+		provenance[s.key] = "env " + name
+	}
+	return nil
+}
+
+// sourcedSetting is a setting as reported by Provenance, with its value formatted
+type sourcedSetting struct {
+	key, value, source string
+}
+
+// sourcedSettings returns every setting of c with its value and where it comes from. The values of the
+// settings tagged `config:"secret"` are masked.
+func (p Provenance) sourcedSettings(c Config) []sourcedSetting {
+	var list []sourcedSetting
+	for _, s := range settings(&c) {
+		source, ok := p[s.key]
+		if !ok {
+			source = "default"
+		}
+		value := fmt.Sprint(s.value.Interface())
+		if m, ok := s.value.Interface().(encoding.TextMarshaler); ok {
+			text, _ := m.MarshalText()
+			value = string(text)
+		}
+		if s.secret && len(value) > 0 {
+			value = "********"
+		}
+		list = append(list, sourcedSetting{s.key, value, source})
+	}
+	return list
+}
+
+// Report lists every setting of c with its value and where it comes from, one per line.
+// The values of the settings tagged `config:"secret"` are masked.
+func (p Provenance) Report(c Config) string {
+	var b strings.Builder
+	for _, s := range p.sourcedSettings(c) {
+		fmt.Fprintf(&b, "%s = %s (%s)\n", s.key, s.value, s.source)
+	}
+	return b.String()
+}
+
+// Log logs every setting of c at debug level, with the setting, value and source fields, masking the
+// secrets as Report does
+func (p Provenance) Log(logger Logger, c Config) {
+	for _, s := range p.sourcedSettings(c) {
+		logger.Debug("Configuration", F("setting", s.key), F("value", s.value), F("source", s.source))
+	}
+}
+
+// dropInFiles returns the configuration files in dir sorted by name, or none if dir does not exist
+func dropInFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && configExtensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// setting is a leaf field of Config: key is the dotted path of the field, e.g. "ThingName"
+// and env the corresponding upper snake case name, e.g. "THING_NAME"
+type setting struct {
+	key    string
+	env    string
+	secret bool
+	value  reflect.Value
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// isSection tells whether the field is a nested section of the configuration rather than a setting
+func isSection(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && !reflect.PtrTo(t).Implements(textUnmarshalerType)
+}
+
+// settings returns the settings of c, in declaration order
+func settings(c *Config) []setting {
+	return appendSettings(nil, reflect.ValueOf(c).Elem(), "", "")
+}
+
+func appendSettings(list []setting, v reflect.Value, key, env string) []setting {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if len(field.PkgPath) > 0 || field.Tag.Get("json") == "-" {
+			continue
+		}
+		fieldKey, fieldEnv := key+field.Name, env+upperSnakeCase(field.Name)
+		if isSection(field.Type) {
+			list = appendSettings(list, v.Field(i), fieldKey+".", fieldEnv+"_")
+			continue
+		}
+		list = append(list, setting{
+			key:    fieldKey,
+			env:    fieldEnv,
+			secret: field.Tag.Get("config") == "secret",
+			value:  v.Field(i),
+		})
+	}
+	return list
+}
+
+func findSetting(c *Config, key string) (setting, bool) {
+	for _, s := range settings(c) {
+		if strings.EqualFold(s.key, key) {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// upperSnakeCase converts a field name like ClientID or CaCertPath to CLIENT_ID or CA_CERT_PATH
+func upperSnakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) &&
+			(unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			b.WriteRune('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// setFromString parses s according to the type of v, as needed for environment variables and flags.
+// Lists are comma separated, maps are written as key=value,key=value.
+func setFromString(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		m := make(map[string]string)
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); len(item) == 0 {
+				continue
+			}
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("expected key=value, got \"%s\"", item)
+			}
+			m[kv[0]] = kv[1]
+		}
+		v.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// fileKeys returns the settings present in a configuration file, for the provenance report
+func fileKeys(file string) ([]string, error) {
+	data, err := readConfigFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return appendKeys(nil, doc, reflect.TypeOf(Config{}), ""), nil
+}
+
+func appendKeys(keys []string, doc map[string]interface{}, t reflect.Type, prefix string) []string {
+	for name, value := range doc {
+		field, ok := t.FieldByNameFunc(func(fieldName string) bool { return strings.EqualFold(fieldName, name) })
+		if !ok {
+			continue
+		}
+		section, isMap := value.(map[string]interface{})
+		if isSection(field.Type) && isMap {
+			keys = appendKeys(keys, section, field.Type, prefix+field.Name+".")
+			continue
+		}
+		keys = append(keys, prefix+field.Name)
+	}
+	return keys
+}
@@ -0,0 +1,235 @@
+package awsiotjobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The formats of NewLogger
+const (
+	logFormatText     = "text"
+	logFormatJSON     = "json"
+	logFormatJournald = "journald"
+)
+
+// Level is the severity of a log message. The zero value is LevelInfo.
+type Level int
+
+// The levels, from the most to the least verbose
+const (
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{LevelDebug: "debug", LevelInfo: "info", LevelWarn: "warn", LevelError: "error"}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// MarshalText encodes the level as debug, info, warn or error
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText parses debug, info, warn (or warning) and error, in any case
+func (l *Level) UnmarshalText(text []byte) error {
+	name := strings.ToLower(string(text))
+	if name == "warning" {
+		name = "warn"
+	}
+	for level, levelName := range levelNames {
+		if name == levelName {
+			*l = level
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid log level \"%s\", expected debug, info, warn or error", text)
+}
+
+// journaldPriority is the syslog priority of the level, see sd-daemon(3)
+func (l Level) journaldPriority() int {
+	switch {
+	case l <= LevelDebug:
+		return 7
+	case l == LevelInfo:
+		return 6
+	case l == LevelWarn:
+		return 4
+	}
+	return 3
+}
+
+// Field is a key/value pair attached to a log message, like the job ID
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns the field key=value
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+/*
+Logger writes leveled messages with structured fields. The agent passes the thingName, jobId, executionNumber
+and step of the job being processed as fields, see JobExecutioner.GetLogger.
+Set Config.Logger to send the messages of the agent to the logging library of the application, otherwise
+they are written to the standard error as configured by Config.LogFormat and Config.LogLevel.
+*/
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+	// With returns a Logger adding fields to every message
+	With(fields ...Field) Logger
+}
+
+// lockedWriter serializes the messages of the loggers sharing the same output, each one is a single Write
+type lockedWriter struct {
+	w   io.Writer
+	mux sync.Mutex
+}
+
+func (lw *lockedWriter) write(b []byte) {
+	lw.mux.Lock()
+	defer lw.mux.Unlock()
+	lw.w.Write(b)
+}
+
+// streamLogger is the Logger returned by NewLogger
+type streamLogger struct {
+	out    *lockedWriter
+	format string
+	level  Level
+	fields []Field
+	now    func() time.Time
+}
+
+/*
+NewLogger returns a Logger writing the messages at level or above to w, one per line, in format:
+  - "text": 2020-03-01T10:00:00Z INFO Connected broker=ssl://abc123-ats.iot.eu-west-1.amazonaws.com:8883
+  - "json": {"time":"2020-03-01T10:00:00Z","level":"info","msg":"Connected","broker":"ssl://..."}
+  - "journald": <6>Connected broker=ssl://..., without a timestamp since journald adds its own and with the
+    priority prefix journald reads from the output of a service
+  - "": journald when the process runs as a systemd service logging to the journal, text otherwise
+*/
+func NewLogger(w io.Writer, format string, level Level) Logger {
+	if len(format) == 0 {
+		format = logFormatText
+		// systemd sets JOURNAL_STREAM when the standard output and error are connected to the journal
+		if len(os.Getenv("JOURNAL_STREAM")) > 0 {
+			format = logFormatJournald
+		}
+	}
+	return &streamLogger{out: &lockedWriter{w: w}, format: format, level: level, now: time.Now}
+}
+
+func (l *streamLogger) Debug(msg string, fields ...Field) { l.log(LevelDebug, msg, fields) }
+func (l *streamLogger) Info(msg string, fields ...Field)  { l.log(LevelInfo, msg, fields) }
+func (l *streamLogger) Warn(msg string, fields ...Field)  { l.log(LevelWarn, msg, fields) }
+func (l *streamLogger) Error(msg string, fields ...Field) { l.log(LevelError, msg, fields) }
+
+func (l *streamLogger) With(fields ...Field) Logger {
+	with := *l
+	with.fields = append(append([]Field(nil), l.fields...), fields...)
+	return &with
+}
+
+func (l *streamLogger) log(level Level, msg string, fields []Field) {
+	if level < l.level {
+		return
+	}
+	all := append(append([]Field(nil), l.fields...), fields...)
+	var b bytes.Buffer
+	switch l.format {
+	case logFormatJSON:
+		b.WriteString(`{"time":`)
+		writeJSON(&b, l.now().Format(time.RFC3339Nano))
+		b.WriteString(`,"level":`)
+		writeJSON(&b, level.String())
+		b.WriteString(`,"msg":`)
+		writeJSON(&b, msg)
+		for _, f := range all {
+			b.WriteByte(',')
+			writeJSON(&b, f.Key)
+			b.WriteByte(':')
+			writeJSON(&b, jsonValue(f.Value))
+		}
+		b.WriteByte('}')
+	case logFormatJournald:
+		fmt.Fprintf(&b, "<%d>%s", level.journaldPriority(), msg)
+		writeText(&b, all)
+	default:
+		fmt.Fprintf(&b, "%s %s %s", l.now().Format(time.RFC3339), strings.ToUpper(level.String()), msg)
+		writeText(&b, all)
+	}
+	b.WriteByte('\n')
+	l.out.write(b.Bytes())
+}
+
+// writeJSON encodes v without escaping the HTML characters, which are common in the topics and URLs
+func writeJSON(b *bytes.Buffer, v interface{}) {
+	encoder := json.NewEncoder(b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		encoder.Encode(fmt.Sprint(v))
+	}
+	b.Truncate(b.Len() - 1) // Encode adds a newline
+}
+
+// jsonValue returns the errors, the durations and the payloads as strings, json would encode them as {},
+// nanoseconds and base64
+func jsonValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case error:
+		return value.Error()
+	case time.Duration:
+		return value.String()
+	case []byte:
+		return string(value)
+	}
+	return v
+}
+
+// writeText writes the fields as key=value, quoting the values with spaces, quotes or equal signs
+func writeText(b *bytes.Buffer, fields []Field) {
+	for _, f := range fields {
+		var value string
+		switch v := f.Value.(type) {
+		case string:
+			value = v
+		case error:
+			value = v.Error()
+		case []byte:
+			value = string(v)
+		default:
+			value = fmt.Sprint(v)
+		}
+		if len(value) == 0 || strings.ContainsAny(value, " \t\r\n\"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(b, " %s=%s", f.Key, value)
+	}
+}
+
+// logger returns Config.Logger, or the logger writing to the standard error as set by LogFormat and LogLevel
+func (c Config) logger() Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return NewLogger(os.Stderr, c.LogFormat, c.LogLevel)
+}
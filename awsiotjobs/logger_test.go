@@ -0,0 +1,84 @@
+package awsiotjobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLogger discards the messages of the code under test
+var testLogger = NewLogger(ioutil.Discard, logFormatText, LevelDebug)
+
+// newBufferLogger returns a logger writing to b at a fixed time
+func newBufferLogger(b *bytes.Buffer, format string, level Level) Logger {
+	logger := NewLogger(b, format, level).(*streamLogger)
+	logger.now = func() time.Time { return time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC) }
+	return logger
+}
+
+func TestLoggerFormats(t *testing.T) {
+	tests := []struct {
+		format, expected string
+	}{
+		{logFormatText, "2020-03-01T10:00:00Z WARN Update queued thingName=thing jobId=job1 error=\"connection lost\" attempt=2\n"},
+		{logFormatJournald, "<4>Update queued thingName=thing jobId=job1 error=\"connection lost\" attempt=2\n"},
+		{logFormatJSON, `{"time":"2020-03-01T10:00:00Z","level":"warn","msg":"Update queued","thingName":"thing","jobId":"job1","error":"connection lost","attempt":2}` + "\n"},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		logger := newBufferLogger(&b, test.format, LevelInfo).With(F("thingName", "thing"), F("jobId", "job1"))
+		logger.Warn("Update queued", F("error", errors.New("connection lost")), F("attempt", 2))
+		if b.String() != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.format, test.expected, b.String())
+		}
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	var b bytes.Buffer
+	logger := newBufferLogger(&b, logFormatJSON, LevelWarn)
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Warn("warn", F("payload", []byte(`{"status":"SUCCEEDED"}`)))
+	logger.Error("error", F("retryIn", 2*time.Second))
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected only the warning and the error, got %s", b.String())
+	}
+	var warn, failure map[string]interface{}
+	json.Unmarshal([]byte(lines[0]), &warn)
+	json.Unmarshal([]byte(lines[1]), &failure)
+	if warn["payload"] != `{"status":"SUCCEEDED"}` || failure["retryIn"] != "2s" {
+		t.Errorf("expected the payload and the duration as strings, got %s", b.String())
+	}
+}
+
+func TestLevelText(t *testing.T) {
+	var level Level
+	if err := level.UnmarshalText([]byte("WARNING")); err != nil || level != LevelWarn {
+		t.Errorf("expected warn, got %s, %v", level, err)
+	}
+	if err := level.UnmarshalText([]byte("verbose")); err == nil {
+		t.Error("expected an unknown level to be reported")
+	}
+	loader := ConfigLoader{Defaults: NewConfig(), Environ: []string{"GOAGENT_LOG_LEVEL=debug"}, EnvPrefix: "GOAGENT_"}
+	c, _, err := loader.Load()
+	if err != nil || c.LogLevel != LevelDebug {
+		t.Errorf("expected the level to be set by the environment, got %s, %v", c.LogLevel, err)
+	}
+}
+
+func TestJournaldByDefaultUnderSystemd(t *testing.T) {
+	defer func(value string) { os.Setenv("JOURNAL_STREAM", value) }(os.Getenv("JOURNAL_STREAM"))
+	os.Setenv("JOURNAL_STREAM", "8:12345")
+	var b bytes.Buffer
+	NewLogger(&b, "", LevelInfo).Info("Connected")
+	if b.String() != "<6>Connected\n" {
+		t.Errorf("expected the journald format, got %s", b.String())
+	}
+}
@@ -1,9 +1,10 @@
 package mender
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"os/exec"
 	"time"
 
@@ -39,38 +40,45 @@ type State struct {
 	Step string `json:"step"`
 }
 
+// logger returns the logger of the execution with the current step
+func (mj *Job) logger() awsiotjobs.Logger {
+	return mj.execution.GetLogger().With(awsiotjobs.F("step", mj.menderState.Step))
+}
+
 func (mj *Job) progress(step string) {
 	mj.menderState.Step = step // should wrap with a mutex
 	err := mj.execution.InProgress(awsiotjobs.StatusDetails{"step": step})
-	if err != nil {
-		log.Printf("Failed to execute InProgress on the Job, got error: %s", err.Error())
+	if err != nil && err != awsiotjobs.ErrQueued {
+		mj.logger().Error("Failed to report the job in progress", awsiotjobs.F("error", err))
 	}
 }
 
 func (mj *Job) success(step string) {
 	mj.menderState.Step = step // should wrap with a mutex
 	err := mj.execution.Success(awsiotjobs.StatusDetails{"step": step})
-	if err != nil {
-		log.Printf("Failed to execute Success on the Job, got error: %s", err.Error())
+	if err != nil && err != awsiotjobs.ErrQueued {
+		mj.logger().Error("Failed to report the job succeeded", awsiotjobs.F("error", err))
 	}
 }
 
 func (mj *Job) fail(err awsiotjobs.JobError) {
 	e := mj.execution.Fail(err)
-	if e != nil {
-		log.Printf("Failed to execute Fail on the Job, got error: %s", err.Error())
+	if e != nil && e != awsiotjobs.ErrQueued {
+		mj.logger().Error("Failed to report the job failed", awsiotjobs.F("error", e), awsiotjobs.F("jobError", err))
 	}
 }
 
 func (mj *Job) reject(err awsiotjobs.JobError) {
 	e := mj.execution.Reject(err)
-	if e != nil {
-		log.Printf("Failed to execute Reject on the Job, got error: %s", err.Error())
+	if e != nil && e != awsiotjobs.ErrQueued {
+		mj.logger().Error("Failed to reject the job", awsiotjobs.F("error", e), awsiotjobs.F("jobError", err))
 	}
 }
 
 // This function implements the logic for the execution of the Mender job
-func (mj *Job) exec(cmd mendercmd.Commander, timeout time.Duration) error {
+// If ctx is cancelled while installing, mender is killed and exec returns without reporting a status: the
+// "installing" step is persisted, so the installation is restarted the next time the job is processed.
+func (mj *Job) exec(ctx context.Context, cmd mendercmd.Commander, timeout time.Duration) error {
 	switch mj.Operation {
 	case "mender_install":
 		// check if we are back after rebooting
@@ -91,48 +99,64 @@ func (mj *Job) exec(cmd mendercmd.Commander, timeout time.Duration) error {
 			}
 			mj.success("committed")
 		default:
-			// If the step is "installing" it could be for different cases
-			// 1- the system rebooted/lost connection and the installation was not completed.
-			// 2- Installation was completed, system rebooted, but the state update was not performed
-			// In case 1 we should restart the installation process
-			// In case 2 we should either make sure this does not happen - ie make the reboot conditional to the
-			// correct persistance of the "rebooting" state; or rely on some other mechanism to detect that the
-			// firmware has been successfully updated and the system has rebooted and is working correctly
+			// If the step is "installing" the system rebooted/lost connection and the installation was not
+			// completed, so we restart the installation process.
+			// The case where the installation completed but the "rebooting" update was lost is covered by the
+			// local journal: the step is read from the local state in parseJobDocument.
 
 			ch := make(chan string)
-			done := make(chan error)
+			done := make(chan error, 1)
 			mj.progress("installing")
-			go cmd.Install(mj.URL, done, ch)
+			start := time.Now()
+			var download downloadCounter
+			installCtx, cancelInstall := context.WithCancel(ctx)
+			defer cancelInstall()
+			go cmd.Install(installCtx, mj.URL, done, ch)
+			// stopInstall kills mender and waits for it to exit, so that it does not keep installing once
+			// the handler has returned
+			stopInstall := func() {
+				cancelInstall()
+				for {
+					select {
+					case <-ch:
+					case <-done:
+						return
+					}
+				}
+			}
 			for {
 				select {
 				case progress := <-ch:
-					log.Printf("%s", progress)
+					download.progress(progress)
 					mj.reportProgress(progress) // report progress via MQTT
 				case err := <-done:
+					recordInstall(time.Since(start), err)
 					if err != nil {
 						jobErr := awsiotjobs.JobError{ErrCode: "ERR_MENDER_INSTALL_FAILED", ErrMessage: err.Error()}
 						mj.fail(jobErr)
 						return jobErr
 					}
-					// This should be changed - setting the rebooting state might fail
-					// and when the system startsup will find a wrong state and will start installing the software again
-					// Must find a way to make this deterministic - maybe relying on mender local state?
+					// The "rebooting" step is journaled locally before the update is sent, so even if the
+					// update is lost we resume from the right step after the reboot.
 					mj.progress("rebooting")
-					go func() {
-						cmd := exec.Command("shutdown", "-r", "now")
-						cmd.Start()
-						err := cmd.Wait()
-						if err != nil {
-							fmt.Println("Could not reboot the system")
-							mj.fail(awsiotjobs.JobError{ErrCode: "ERROR_UNABLE_TO_REBOOT", ErrMessage: err.Error()})
-							return
-						}
-						fmt.Println("rebooting...")
-						mj.execution.Terminate() //Should be called by the agent code and not the library - based on signalling from the OS when shutting down
-					}()
+					// The agent is stopped by systemd as part of the reboot
+					err = exec.Command("shutdown", "-r", "now").Run()
+					if err != nil {
+						mj.logger().Error("Could not reboot the system", awsiotjobs.F("error", err))
+						jobErr := awsiotjobs.JobError{ErrCode: "ERROR_UNABLE_TO_REBOOT", ErrMessage: err.Error()}
+						mj.fail(jobErr)
+						return jobErr
+					}
+					mj.logger().Info("Rebooting")
 					return nil
+				case <-ctx.Done():
+					mj.logger().Warn("Installation interrupted", awsiotjobs.F("error", ctx.Err()))
+					stopInstall()
+					return ctx.Err()
 				case <-time.After(timeout): // timeout value can be in doc
-					fmt.Printf("install timeout")
+					mj.logger().Error("Installation timed out", awsiotjobs.F("timeout", timeout))
+					stopInstall()
+					recordInstall(time.Since(start), errors.New("timeout"))
 					jobErr := awsiotjobs.JobError{ErrCode: "ERR_MENDER_INSTALL_TIMEOUT", ErrMessage: "mender timed out"}
 					mj.fail(jobErr)
 					return jobErr
@@ -177,12 +201,30 @@ func parseJobDocument(jobExecution awsiotjobs.JobExecutioner) (Job, error) {
 	var menderState State
 	statusDetails, _ := json.Marshal(jobExecution.GetStatusDetails())
 	json.Unmarshal(statusDetails, &menderState)
+	// The local state is the truth - it is journaled before every update, so it is at least as recent
+	// as what AWS IoT knows
+	if localStatusDetails := jobExecution.GetLocalStatusDetails(); localStatusDetails != nil {
+		var localState State
+		localJSON, _ := json.Marshal(localStatusDetails)
+		json.Unmarshal(localJSON, &localState)
+		if localState.Step != menderState.Step {
+			jobExecution.GetLogger().Warn("Local step differs from the reported step - using the local step",
+				awsiotjobs.F("step", localState.Step), awsiotjobs.F("reportedStep", menderState.Step))
+		}
+		menderState = localState
+	}
 	job.menderState = menderState
 	return job, nil
 }
 
+// Register adds the mender operations to the router
+func Register(router *awsiotjobs.Router) {
+	router.Handle("mender_install", Process)
+	router.Handle("mender_rollback", Process)
+}
+
 // Process is the JobExecution handler
-func Process(jobExecution awsiotjobs.JobExecutioner) {
+func Process(ctx context.Context, jobExecution awsiotjobs.JobExecutioner) {
 	job, err := parseJobDocument(jobExecution)
 	if err != nil {
 		jobError, ok := err.(awsiotjobs.JobError)
@@ -190,17 +232,19 @@ func Process(jobExecution awsiotjobs.JobExecutioner) {
 			switch jobError.ErrCode {
 			case "ERR_MENDER_MISSING_URL":
 			case "ERR_JOB_INVALID_OPERATION":
-				fmt.Printf("Invalid job document - Rejecting\n")
+				jobExecution.GetLogger().Warn("Invalid job document - Rejecting", awsiotjobs.F("error", err))
 				job.reject(err.(awsiotjobs.JobError))
 			default:
-				fmt.Printf("Unknown - Ignoring")
+				jobExecution.GetLogger().Warn("Unknown job error - Ignoring", awsiotjobs.F("error", err))
 			}
 		} else {
-			fmt.Printf("Unknown error %s - Ignoring\n", err.Error())
+			jobExecution.GetLogger().Error("Unknown error - Ignoring", awsiotjobs.F("error", err))
 		}
 	} else {
-		go func() {
-			job.exec(&mendercmd.MenderCommand{}, timeout)
-		}()
+		logger := jobExecution.GetLogger()
+		output := func(command, line string) {
+			logger.Debug("mender", awsiotjobs.F("command", command), awsiotjobs.F("output", line))
+		}
+		job.exec(ctx, &mendercmd.MenderCommand{Output: output}, timeout)
 	}
 }
@@ -1,7 +1,9 @@
 package mender
 
 import (
+	"context"
 	"errors"
+	"io/ioutil"
 	"reflect"
 	"testing"
 	"time"
@@ -14,7 +16,8 @@ const testTimeout = 500 * time.Millisecond
 
 type JobExecutionMock struct {
 	mock.Mock
-	jobExecution awsiotjobs.JobExecution
+	jobExecution       *awsiotjobs.JobExecution
+	localStatusDetails awsiotjobs.StatusDetails
 }
 
 func (j *JobExecutionMock) GetStatusDetails() awsiotjobs.StatusDetails {
@@ -23,6 +26,12 @@ func (j *JobExecutionMock) GetStatusDetails() awsiotjobs.StatusDetails {
 	return j.jobExecution.StatusDetails
 }
 
+func (j *JobExecutionMock) GetLocalStatusDetails() awsiotjobs.StatusDetails {
+	j.On("GetLocalStatusDetails").Return(j.localStatusDetails)
+	j.Called()
+	return j.localStatusDetails
+}
+
 func (j *JobExecutionMock) GetJobDocument() awsiotjobs.JobDocument {
 	j.On("GetJobDocument").Return(j.jobExecution.JobDocument)
 	return j.jobExecution.JobDocument
@@ -40,6 +49,10 @@ func (j *JobExecutionMock) GetThingName() string {
 	return "thingName"
 }
 
+func (j *JobExecutionMock) GetLogger() awsiotjobs.Logger {
+	return awsiotjobs.NewLogger(ioutil.Discard, "text", awsiotjobs.LevelDebug)
+}
+
 func (j *JobExecutionMock) Publish(t string, q byte, p interface{}) {
 	j.On("Publish").Return()
 	j.Called()
@@ -69,11 +82,6 @@ func (j *JobExecutionMock) Reject(e awsiotjobs.JobError) error {
 	return nil
 }
 
-func (j *JobExecutionMock) Terminate() {
-	j.On("Terminate").Return()
-	j.Called()
-}
-
 func TestParseJobMessageInstall(t *testing.T) {
 	doc := awsiotjobs.JobExecution{
 		JobDocument: map[string]interface{}{
@@ -83,7 +91,7 @@ func TestParseJobMessageInstall(t *testing.T) {
 		Status:        "QUEUED",
 		StatusDetails: map[string]interface{}{},
 	}
-	amock := JobExecutionMock{jobExecution: doc}
+	amock := JobExecutionMock{jobExecution: &doc}
 	job, _ := parseJobDocument(&amock)
 	wanted := Job{
 		"mender_install",
@@ -113,7 +121,7 @@ func TestParseJobMessageRollback(t *testing.T) {
 		VersionNumber:   1,
 		ExecutionNumber: 1000,
 	}
-	amock := JobExecutionMock{jobExecution: doc}
+	amock := JobExecutionMock{jobExecution: &doc}
 	job, _ := parseJobDocument(&amock)
 	wanted := Job{
 		"mender_rollback",
@@ -128,6 +136,23 @@ func TestParseJobMessageRollback(t *testing.T) {
 
 }
 
+func TestParseJobMessageLocalStateWins(t *testing.T) {
+	doc := awsiotjobs.JobExecution{
+		JobDocument: map[string]interface{}{
+			"operation": "mender_install",
+			"url":       "http://test",
+		},
+		Status:        "IN_PROGRESS",
+		StatusDetails: map[string]interface{}{"step": "installing"},
+	}
+	amock := JobExecutionMock{jobExecution: &doc, localStatusDetails: awsiotjobs.StatusDetails{"step": "rebooting"}}
+	job, _ := parseJobDocument(&amock)
+	wanted := State{Step: "rebooting"}
+	if job.menderState != wanted {
+		t.Errorf("wanted %v got %v", wanted, job.menderState)
+	}
+}
+
 func TestParseJobMessageInstallMissingUrl(t *testing.T) {
 	doc := awsiotjobs.JobExecution{
 		JobID:     "job",
@@ -144,7 +169,7 @@ func TestParseJobMessageInstallMissingUrl(t *testing.T) {
 		ExecutionNumber: 1000,
 	}
 
-	amock := JobExecutionMock{jobExecution: doc}
+	amock := JobExecutionMock{jobExecution: &doc}
 	_, err := parseJobDocument(&amock)
 	wanted := awsiotjobs.JobError{ErrCode: "ERR_MENDER_MISSING_URL", ErrMessage: "missing url parameter"}
 	if err != wanted {
@@ -160,8 +185,8 @@ func TestProcessMissingOperationFail(t *testing.T) {
 		Status:        "QUEUED",
 		StatusDetails: map[string]interface{}{},
 	}
-	amock := JobExecutionMock{jobExecution: doc}
-	Process(&amock)
+	amock := JobExecutionMock{jobExecution: &doc}
+	Process(context.Background(), &amock)
 	amock.AssertCalled(t, "Reject")
 }
 
@@ -173,8 +198,8 @@ func TestProcessMissingUrlFail(t *testing.T) {
 		Status:        "QUEUED",
 		StatusDetails: map[string]interface{}{},
 	}
-	amock := JobExecutionMock{jobExecution: doc}
-	Process(&amock)
+	amock := JobExecutionMock{jobExecution: &doc}
+	Process(context.Background(), &amock)
 	amock.AssertCalled(t, "Reject")
 }
 
@@ -182,7 +207,7 @@ type CommandFail struct {
 	mock.Mock
 }
 
-func (c *CommandFail) Install(url string, done chan error, progress chan string) error {
+func (c *CommandFail) Install(ctx context.Context, url string, done chan error, progress chan string) error {
 	done <- errors.New("install error")
 	return errors.New("install error")
 }
@@ -207,11 +232,11 @@ func TestExecInstallFail(t *testing.T) {
 		VersionNumber: 1,
 	}
 
-	amock := JobExecutionMock{jobExecution: doc}
+	amock := JobExecutionMock{jobExecution: &doc}
 
 	job, _ := parseJobDocument(&amock)
 	cmd := &CommandFail{}
-	err := job.exec(cmd, testTimeout)
+	err := job.exec(context.Background(), cmd, testTimeout)
 	time.Sleep(1 * time.Second)
 	jobError, ok := err.(awsiotjobs.JobError)
 	if !ok {
@@ -235,11 +260,11 @@ func TestExecCommitFail(t *testing.T) {
 		VersionNumber: 1,
 	}
 
-	amock := JobExecutionMock{jobExecution: doc}
+	amock := JobExecutionMock{jobExecution: &doc}
 
 	job, _ := parseJobDocument(&amock)
 	cmd := &CommandFail{}
-	err := job.exec(cmd, testTimeout)
+	err := job.exec(context.Background(), cmd, testTimeout)
 	time.Sleep(1 * time.Second)
 	jobError, ok := err.(awsiotjobs.JobError)
 	if !ok {
@@ -252,13 +277,18 @@ func TestExecCommitFail(t *testing.T) {
 	amock.AssertCalled(t, "Fail")
 }
 
+// CommandTimeout installs until it is killed by cancelling ctx, like mender would
 type CommandTimeout struct {
 	mock.Mock
+	killed bool
 }
 
-func (c *CommandTimeout) Install(url string, done chan error, progress chan string) error {
-	time.Sleep(testTimeout * 2)
-	return nil
+func (c *CommandTimeout) Install(ctx context.Context, url string, done chan error, progress chan string) error {
+	progress <- "installing"
+	<-ctx.Done()
+	c.killed = true
+	done <- ctx.Err()
+	return ctx.Err()
 }
 
 func (c *CommandTimeout) Commit() error {
@@ -281,11 +311,11 @@ func TestExecTimeoutFail(t *testing.T) {
 		VersionNumber: 1,
 	}
 
-	amock := JobExecutionMock{jobExecution: doc}
+	amock := JobExecutionMock{jobExecution: &doc}
 
 	job, _ := parseJobDocument(&amock)
 	cmd := &CommandTimeout{}
-	err := job.exec(cmd, testTimeout)
+	err := job.exec(context.Background(), cmd, testTimeout)
 	time.Sleep(1 * time.Second)
 	jobError, ok := err.(awsiotjobs.JobError)
 	if !ok {
@@ -295,5 +325,35 @@ func TestExecTimeoutFail(t *testing.T) {
 	if jobError.ErrCode != wanted {
 		t.Errorf("Expected \"%s\", got \"%s\"", wanted, jobError.ErrCode)
 	}
+	if !cmd.killed {
+		t.Error("Expected mender to be killed on timeout")
+	}
 	amock.AssertCalled(t, "Fail")
 }
+
+func TestExecInstallCancelled(t *testing.T) {
+	doc := awsiotjobs.JobExecution{
+		JobDocument: awsiotjobs.JobDocument{
+			"operation": "mender_install",
+			"url":       "http://test",
+		},
+		Status:        "QUEUED",
+		StatusDetails: awsiotjobs.StatusDetails{},
+		VersionNumber: 1,
+	}
+
+	amock := JobExecutionMock{jobExecution: &doc}
+
+	job, _ := parseJobDocument(&amock)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cmd := &CommandTimeout{}
+	err := job.exec(ctx, cmd, testTimeout)
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled got %v", err)
+	}
+	if !cmd.killed {
+		t.Error("Expected mender to be killed when cancelled")
+	}
+	amock.AssertNotCalled(t, "Fail")
+}
@@ -0,0 +1,66 @@
+package mender
+
+import (
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Stats counts the mender installations since the agent started, see GetStats
+type Stats struct {
+	// Installs counts the installations which completed, before the reboot, InstallFailures the others
+	Installs        int64
+	InstallFailures int64
+	// InstallDuration is the total time spent installing, successfully or not
+	InstallDuration time.Duration
+	// DownloadedBytes is the size of the artifacts downloaded, as reported by the mender progress
+	DownloadedBytes int64
+}
+
+var stats struct {
+	Stats
+	mux sync.Mutex
+}
+
+// GetStats returns the counters of the installations
+func GetStats() Stats {
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+	return stats.Stats
+}
+
+func recordInstall(duration time.Duration, err error) {
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+	if err != nil {
+		stats.InstallFailures++
+	} else {
+		stats.Installs++
+	}
+	stats.InstallDuration += duration
+}
+
+// The progress lines of mender -install end with the size downloaded so far, like
+// "................................   5% 12288 KiB"
+var progressRegexp = regexp.MustCompile(`(\d+) KiB\s*$`)
+
+// downloadCounter adds the progress of an installation to Stats.DownloadedBytes
+type downloadCounter struct {
+	downloaded int64
+}
+
+func (d *downloadCounter) progress(line string) {
+	m := progressRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+	kib, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil || kib*1024 <= d.downloaded {
+		return
+	}
+	stats.mux.Lock()
+	stats.DownloadedBytes += kib*1024 - d.downloaded
+	stats.mux.Unlock()
+	d.downloaded = kib * 1024
+}
@@ -0,0 +1,39 @@
+package mender
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws-samples/aws-iot-jobs-full-system-update/goagent/awsiotjobs"
+)
+
+func TestDownloadCounter(t *testing.T) {
+	before := GetStats().DownloadedBytes
+	var download downloadCounter
+	for _, line := range []string{
+		"Installing Artifact of size 102400...",
+		"................................   5% 12288 KiB",
+		"................................  10% 24576 KiB",
+		"................................  10% 24576 KiB",
+	} {
+		download.progress(line)
+	}
+	if got := GetStats().DownloadedBytes - before; got != 24576*1024 {
+		t.Errorf("expected %d bytes downloaded, got %d", 24576*1024, got)
+	}
+}
+
+func TestInstallFailureRecorded(t *testing.T) {
+	doc := awsiotjobs.JobExecution{
+		JobDocument:   awsiotjobs.JobDocument{"operation": "mender_install", "url": "http://test"},
+		StatusDetails: awsiotjobs.StatusDetails{},
+	}
+	amock := JobExecutionMock{jobExecution: &doc}
+	job, _ := parseJobDocument(&amock)
+	before := GetStats()
+	job.exec(context.Background(), &CommandFail{}, testTimeout)
+	after := GetStats()
+	if after.InstallFailures != before.InstallFailures+1 || after.Installs != before.Installs {
+		t.Errorf("expected a failed installation to be recorded, got %+v then %+v", before, after)
+	}
+}
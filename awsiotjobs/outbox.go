@@ -0,0 +1,346 @@
+package awsiotjobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxOutboxMessages bounds the progress messages kept while offline, the oldest ones are dropped first.
+// The status updates are always kept, there is at most one IN_PROGRESS update per job.
+var maxOutboxMessages = 1000
+
+// While connected, the outbox is flushed again after a failure waiting from minFlushRetryDelay up to
+// maxFlushRetryDelay, doubling the delay each time. It is a variable for the tests.
+var minFlushRetryDelay = time.Second
+
+const maxFlushRetryDelay = time.Minute
+
+// errNoOutbox is returned when queuing without an outbox
+var errNoOutbox = errors.New("awsiotjobs: no outbox")
+
+// outboxEntry is a message which could not be published, waiting for the connection to come back.
+// Status is set for the job execution updates, which are replayed as requests and must be accepted by AWS IoT,
+// and is empty for the messages published by the handlers.
+type outboxEntry struct {
+	Seq     uint64 `json:"seq"`
+	Topic   string `json:"topic"`
+	QoS     byte   `json:"qos"`
+	Payload []byte `json:"payload"`
+	JobID   string `json:"jobId,omitempty"`
+	Status  string `json:"status,omitempty"`
+}
+
+func (e outboxEntry) isUpdate() bool {
+	return len(e.Status) > 0
+}
+
+/*
+outbox keeps the outgoing messages in order until they are published. With a directory, every entry is a file
+named after its sequence number, so the queue survives a reboot; without one the queue is only kept in memory.
+A nil outbox is valid and queues nothing.
+*/
+type outbox struct {
+	dir     string
+	entries []outboxEntry
+	next    uint64
+	logger  Logger
+	added   chan struct{} // signaled by add, wakes up Client.flushQueued
+	mux     sync.Mutex
+	flushes sync.Mutex // serializes flush, so that the entries are sent once and in order
+}
+
+// newOutbox returns the outbox persisted in dir, loading the entries left by a previous run
+func newOutbox(dir string, logger Logger) *outbox {
+	o := &outbox{dir: dir, next: 1, logger: logger, added: make(chan struct{}, 1)}
+	if len(dir) == 0 {
+		return o
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Error("Outbox - Cannot read the queued messages", F("dir", dir), F("error", err))
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		var e outboxEntry
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &e)
+		}
+		if err != nil {
+			logger.Warn("Outbox - Discarding an invalid message", F("path", path), F("error", err))
+			os.Remove(path)
+			continue
+		}
+		o.entries = append(o.entries, e)
+	}
+	sort.Slice(o.entries, func(i, j int) bool { return o.entries[i].Seq < o.entries[j].Seq })
+	if n := len(o.entries); n > 0 {
+		o.next = o.entries[n-1].Seq + 1
+		logger.Info("Outbox - Messages waiting to be sent", F("queued", n))
+	}
+	return o
+}
+
+func (o *outbox) path(seq uint64) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%020d.json", seq))
+}
+
+// add queues e after the other entries. A status update supersedes the IN_PROGRESS updates queued for the
+// same job, which are removed: AWS IoT only needs the latest status and details.
+func (o *outbox) add(e outboxEntry) error {
+	if o == nil {
+		return errNoOutbox
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	defer o.wake()
+	e.Seq = o.next
+	if len(o.dir) > 0 {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(o.dir, 0700); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(o.path(e.Seq), data, 0600); err != nil {
+			return err
+		}
+	}
+	o.next++
+
+	messages := 0
+	kept := o.entries[:0]
+	for _, queued := range o.entries {
+		superseded := e.isUpdate() && queued.isUpdate() && queued.JobID == e.JobID && queued.Status == "IN_PROGRESS"
+		if superseded {
+			o.removeFile(queued.Seq)
+			continue
+		}
+		if !queued.isUpdate() {
+			messages++
+		}
+		kept = append(kept, queued)
+	}
+	o.entries = append(kept, e)
+	if !e.isUpdate() {
+		messages++
+	}
+	for i := 0; messages > maxOutboxMessages && i < len(o.entries); {
+		if o.entries[i].isUpdate() {
+			i++
+			continue
+		}
+		o.logger.Warn("Outbox - Full, dropping the oldest message", F("topic", o.entries[i].Topic))
+		o.removeFile(o.entries[i].Seq)
+		o.entries = append(o.entries[:i], o.entries[i+1:]...)
+		messages--
+	}
+	return nil
+}
+
+// wake signals that entries are waiting, without blocking when a signal is already pending
+func (o *outbox) wake() {
+	if o == nil {
+		return
+	}
+	select {
+	case o.added <- struct{}{}:
+	default:
+	}
+}
+
+// wakeups returns the channel signaled by wake, nil for a nil outbox
+func (o *outbox) wakeups() <-chan struct{} {
+	if o == nil {
+		return nil
+	}
+	return o.added
+}
+
+// removeFile must be called holding o.mux
+func (o *outbox) removeFile(seq uint64) {
+	if len(o.dir) == 0 {
+		return
+	}
+	if err := os.Remove(o.path(seq)); err != nil && !os.IsNotExist(err) {
+		o.logger.Error("Outbox - Cannot remove a message", F("seq", seq), F("error", err))
+	}
+}
+
+func (o *outbox) remove(seq uint64) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	for i, e := range o.entries {
+		if e.Seq == seq {
+			o.entries = append(o.entries[:i], o.entries[i+1:]...)
+			o.removeFile(seq)
+			return
+		}
+	}
+}
+
+// first returns the oldest entry, if any
+func (o *outbox) first() (outboxEntry, bool) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if len(o.entries) == 0 {
+		return outboxEntry{}, false
+	}
+	return o.entries[0], true
+}
+
+func (o *outbox) len() int {
+	if o == nil {
+		return 0
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return len(o.entries)
+}
+
+// hasTerminal tells whether a terminal status is queued for jobID
+func (o *outbox) hasTerminal(jobID string) bool {
+	if o == nil {
+		return false
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	for _, e := range o.entries {
+		if e.JobID == jobID && isTerminal(e.Status) {
+			return true
+		}
+	}
+	return false
+}
+
+// flush sends the entries in order with send, including the ones added meanwhile, and stops at the first
+// error. Entries rejected by AWS IoT, reported as a JobError, are dropped since sending them again would
+// not help.
+func (o *outbox) flush(send func(e outboxEntry) error) error {
+	if o == nil {
+		return nil
+	}
+	o.flushes.Lock()
+	defer o.flushes.Unlock()
+	for {
+		e, ok := o.first()
+		if !ok {
+			return nil
+		}
+		err := send(e)
+		if jobError, rejected := err.(JobError); rejected {
+			o.logger.Warn("Outbox - Update rejected, dropping it", F("jobId", e.JobID), F("status", e.Status), F("error", jobError))
+		} else if err != nil {
+			return err
+		}
+		o.remove(e.Seq)
+	}
+}
+
+// errPublishTimeout is returned when a queued message is not acknowledged within publishTimeout
+var errPublishTimeout = errors.New("awsiotjobs: publish timed out")
+
+// outboxDir returns where the outbox is persisted, or "" to keep it in memory when there is no StateDir
+func outboxDir(stateDir string) string {
+	if len(stateDir) == 0 {
+		return ""
+	}
+	return filepath.Join(stateDir, "outbox")
+}
+
+// flushOutbox sends the queued messages, see outbox.flush
+func (client *Client) flushOutbox() error {
+	return client.outbox.flush(client.sendQueued)
+}
+
+/*
+flushQueued sends the queued messages when entries are added, until ctx is done. A failed flush is tried
+again with backoff while the connection is up; once it is lost, onConnect flushes the outbox when reconnecting.
+Without it, an update queued after a request timed out on a healthy connection would never be sent.
+*/
+func (client *Client) flushQueued(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-client.outbox.wakeups():
+		}
+		for delay := minFlushRetryDelay; client.stats.isConnected() && client.outbox.len() > 0; {
+			err := client.flushOutbox()
+			if err == nil {
+				break
+			}
+			client.Logger().Warn("Cannot send the queued messages", F("queued", client.outbox.len()), F("error", err), F("retryIn", delay))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxFlushRetryDelay {
+				delay = maxFlushRetryDelay
+			}
+		}
+	}
+}
+
+// sendQueued publishes a queued message, or sends a queued update and waits for AWS IoT to accept it
+func (client *Client) sendQueued(e outboxEntry) error {
+	if !e.isUpdate() {
+		t := client.mqttPublish(e.Topic, e.QoS, e.Payload)
+		if !t.WaitTimeout(publishTimeout) {
+			return errPublishTimeout
+		}
+		return t.Error()
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(e.Payload, &payload); err != nil {
+		client.Logger().Warn("Outbox - Dropping an invalid update", F("jobId", e.JobID), F("error", err))
+		return nil
+	}
+	resp, err := client.request(context.Background(), e.Topic, payload)
+	if err != nil {
+		return err
+	}
+	client.Logger().Info("Outbox - Update sent", F("jobId", e.JobID), F("status", e.Status))
+	if je := client.executions.get(e.JobID); je != nil {
+		je.applyUpdate(resp)
+	}
+	return nil
+}
+
+// publish sends a message of a job handler, queuing it when it cannot be published or when messages are
+// already waiting, see flushQueued
+func (client *Client) publish(topic string, qos byte, payload interface{}) {
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	default:
+		client.mqttPublish(topic, qos, payload)
+		return
+	}
+	if client.outbox.len() == 0 {
+		t := client.mqttPublish(topic, qos, data)
+		if t.WaitTimeout(publishTimeout) && t.Error() == nil {
+			return
+		}
+	}
+	if err := client.outbox.add(outboxEntry{Topic: topic, QoS: qos, Payload: data}); err != nil {
+		client.Logger().Error("Cannot queue the message", F("topic", topic), F("error", err))
+	}
+}
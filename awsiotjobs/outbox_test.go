@@ -0,0 +1,209 @@
+package awsiotjobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOutboxCollapsesAndPersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := newOutbox(dir, testLogger)
+	for _, e := range []outboxEntry{
+		{Topic: "progress", Payload: []byte("1")},
+		{Topic: "update1", JobID: "job1", Status: "IN_PROGRESS"},
+		{Topic: "update2", JobID: "job2", Status: "IN_PROGRESS"},
+		{Topic: "update1", JobID: "job1", Status: "IN_PROGRESS", Payload: []byte("rebooting")},
+		{Topic: "update1", JobID: "job1", Status: "SUCCEEDED"},
+	} {
+		if err := o.add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded := newOutbox(dir, testLogger)
+	var got []string
+	reloaded.flush(func(e outboxEntry) error {
+		got = append(got, e.Topic+" "+e.Status)
+		return nil
+	})
+	wanted := []string{"progress ", "update2 IN_PROGRESS", "update1 SUCCEEDED"}
+	if len(got) != len(wanted) {
+		t.Fatalf("\nwanted: %v,\ngot     %v", wanted, got)
+	}
+	for i := range wanted {
+		if got[i] != wanted[i] {
+			t.Errorf("\nwanted: %v,\ngot     %v", wanted, got)
+			break
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected the sent entries to be removed, %d files left", len(files))
+	}
+	if err := reloaded.add(outboxEntry{Topic: "next"}); err != nil || reloaded.entries[0].Seq != 6 {
+		t.Errorf("expected the sequence to continue after a reload, got %v", reloaded.entries)
+	}
+}
+
+func TestOutboxFlushStopsOnError(t *testing.T) {
+	o := newOutbox("", testLogger)
+	o.add(outboxEntry{Topic: "a"})
+	o.add(outboxEntry{Topic: "b", JobID: "job1", Status: "SUCCEEDED"})
+	o.add(outboxEntry{Topic: "c"})
+
+	down := errors.New("not connected")
+	if err := o.flush(func(e outboxEntry) error { return down }); err != down || o.len() != 3 {
+		t.Errorf("expected the entries to be kept, got %v and %d entries", err, o.len())
+	}
+	// A rejected update is dropped, the following entries are still sent
+	var sent []string
+	err := o.flush(func(e outboxEntry) error {
+		sent = append(sent, e.Topic)
+		if e.isUpdate() {
+			return JobError{ErrCode: "TerminalStateReached"}
+		}
+		return nil
+	})
+	if err != nil || o.len() != 0 || len(sent) != 3 {
+		t.Errorf("expected every entry to be sent, got %v, %v", err, sent)
+	}
+}
+
+func TestOutboxDropsOldestMessages(t *testing.T) {
+	defer func(max int) { maxOutboxMessages = max }(maxOutboxMessages)
+	maxOutboxMessages = 2
+	o := newOutbox("", testLogger)
+	o.add(outboxEntry{Topic: "a"})
+	o.add(outboxEntry{Topic: "update", JobID: "job1", Status: "IN_PROGRESS"})
+	o.add(outboxEntry{Topic: "b"})
+	o.add(outboxEntry{Topic: "c"})
+	if len(o.entries) != 3 || o.entries[0].Topic != "update" || o.entries[1].Topic != "b" {
+		t.Errorf("expected the oldest message to be dropped, got %v", o.entries)
+	}
+}
+
+func TestUpdatesQueuedWhileOffline(t *testing.T) {
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	client.outbox = newOutbox("", testLogger)
+	je := &JobExecution{JobID: "job1", VersionNumber: 1, client: client}
+	client.executions.add(je)
+
+	iot.publishError = errors.New("not connected")
+	if err := je.InProgress(StatusDetails{"step": "installing"}); err != ErrQueued {
+		t.Fatalf("expected the update to be queued, got %v", err)
+	}
+	je.Publish("mender/thing/job/job1/progress", 0, []byte(`{"progress":"50%"}`))
+	if err := je.InProgress(StatusDetails{"step": "rebooting"}); err != ErrQueued {
+		t.Fatalf("expected the update to be queued, got %v", err)
+	}
+	if client.outbox.len() != 2 {
+		t.Fatalf("expected the progress message and the last update to be queued, got %d entries", client.outbox.len())
+	}
+	if err := je.Success(StatusDetails{"step": "committed"}); err != ErrQueued {
+		t.Fatalf("expected the final status to be queued, got %v", err)
+	}
+	if client.outbox.len() != 2 || client.executions.get("job1") != nil {
+		t.Fatalf("expected the final status to replace the queued update, got %d entries", client.outbox.len())
+	}
+	// A notification for the job must not run it again before the final status is sent
+	client.jobHandler(nil, &fakeMessage{payload: []byte(`{"execution":{"jobId":"job1","status":"IN_PROGRESS"}}`)})
+	if client.executions.get("job1") != nil {
+		t.Error("expected the job to be ignored while its final status is queued")
+	}
+
+	var updates []map[string]interface{}
+	iot.onPublish = func(topic string, payload []byte) {
+		if topic != "$aws/things/thing/jobs/job1/update" {
+			return
+		}
+		var update map[string]interface{}
+		json.Unmarshal(payload, &update)
+		updates = append(updates, update)
+		iot.deliver(topic+"/accepted", map[string]interface{}{"clientToken": clientToken(payload)})
+	}
+	iot.publishError = nil
+	if err := client.ConnectAndSubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	wanted := []string{"mender/thing/job/job1/progress", "$aws/things/thing/jobs/job1/update", "$aws/things/thing/jobs/start-next"}
+	if !reflect.DeepEqual(iot.published, wanted) {
+		t.Errorf("\nwanted: %v,\ngot     %v", wanted, iot.published)
+	}
+	if len(updates) != 1 || updates[0]["status"] != "SUCCEEDED" {
+		t.Fatalf("expected the SUCCEEDED update to be replayed, got %v", updates)
+	}
+	if _, ok := updates[0]["expectedVersion"]; ok {
+		t.Error("expected the replayed update not to carry the version known when it was queued")
+	}
+	if client.outbox.len() != 0 {
+		t.Errorf("expected the outbox to be empty, got %d entries", client.outbox.len())
+	}
+}
+
+func TestUpdateQueuedWhileConnectedIsFlushed(t *testing.T) {
+	defer func(d time.Duration) { minFlushRetryDelay = d }(minFlushRetryDelay)
+	minFlushRetryDelay = time.Millisecond
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	client.outbox = newOutbox("", testLogger)
+	updates := make(chan string, 1)
+	iot.onPublish = func(topic string, payload []byte) {
+		if topic != "$aws/things/thing/jobs/job1/update" {
+			return
+		}
+		var update map[string]interface{}
+		json.Unmarshal(payload, &update)
+		iot.deliver(topic+"/accepted", map[string]interface{}{"clientToken": clientToken(payload)})
+		updates <- update["status"].(string)
+	}
+	if err := client.ConnectAndSubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	flushed := make(chan struct{})
+	go func() {
+		client.flushQueued(ctx)
+		close(flushed)
+	}()
+	defer func() {
+		cancel()
+		<-flushed
+	}()
+
+	// The update fails although the connection is up, as when the request times out
+	je := &JobExecution{JobID: "job1", VersionNumber: 1, client: client}
+	client.executions.add(je)
+	iot.mux.Lock()
+	iot.publishError = errors.New("publish failed")
+	iot.mux.Unlock()
+	if err := je.Success(StatusDetails{"step": "committed"}); err != ErrQueued {
+		t.Fatalf("expected the final status to be queued, got %v", err)
+	}
+	iot.mux.Lock()
+	iot.publishError = nil
+	iot.mux.Unlock()
+	select {
+	case status := <-updates:
+		if status != "SUCCEEDED" {
+			t.Errorf("expected the SUCCEEDED update to be sent, got %s", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the queued update to be sent without waiting for a reconnection")
+	}
+	for deadline := time.Now().Add(time.Second); client.outbox.len() > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the outbox to be empty, got %d entries", client.outbox.len())
+		}
+	}
+}
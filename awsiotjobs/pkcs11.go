@@ -0,0 +1,67 @@
+//go:build cgo
+// +build cgo
+
+package awsiotjobs
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"sync"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// pkcs11Contexts keeps the PKCS#11 sessions open for the lifetime of the process: the signers of a previous
+// connection stay usable, as Reconfigure may go back to it
+var pkcs11Contexts = struct {
+	byConfig map[PKCS11Config]*crypto11.Context
+	mux      sync.Mutex
+}{byConfig: make(map[PKCS11Config]*crypto11.Context)}
+
+func (p PKCS11Config) context() (*crypto11.Context, error) {
+	pkcs11Contexts.mux.Lock()
+	defer pkcs11Contexts.mux.Unlock()
+	if ctx, ok := pkcs11Contexts.byConfig[p]; ok {
+		return ctx, nil
+	}
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:        p.ModulePath,
+		TokenLabel:  p.TokenLabel,
+		TokenSerial: p.TokenSerial,
+		Pin:         p.Pin,
+	})
+	if err != nil {
+		return nil, err
+	}
+	pkcs11Contexts.byConfig[p] = ctx
+	return ctx, nil
+}
+
+// Signer finds the key in the token. The key never leaves the token, which signs the TLS handshakes.
+func (p PKCS11Config) Signer(cert *x509.Certificate) (crypto.Signer, error) {
+	id, err := hex.DecodeString(p.KeyID)
+	if err != nil {
+		return nil, &CredentialsError{p.uri(), err}
+	}
+	var label []byte
+	if len(p.KeyLabel) > 0 {
+		label = []byte(p.KeyLabel)
+	}
+	if len(id) == 0 {
+		id = nil
+	}
+	ctx, err := p.context()
+	if err != nil {
+		return nil, &CredentialsError{p.uri(), err}
+	}
+	signer, err := ctx.FindKeyPair(id, label)
+	if err != nil {
+		return nil, &CredentialsError{p.uri(), err}
+	}
+	if signer == nil {
+		return nil, &CredentialsError{p.uri(), errors.New("key not found")}
+	}
+	return signer, nil
+}
@@ -0,0 +1,15 @@
+//go:build !cgo
+// +build !cgo
+
+package awsiotjobs
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+)
+
+// Signer always fails: the PKCS#11 libraries are loaded through cgo
+func (p PKCS11Config) Signer(cert *x509.Certificate) (crypto.Signer, error) {
+	return nil, &CredentialsError{p.uri(), errors.New("PKCS#11 is not supported by this build, rebuild with CGO_ENABLED=1")}
+}
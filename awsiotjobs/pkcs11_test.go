@@ -0,0 +1,79 @@
+//go:build cgo
+// +build cgo
+
+package awsiotjobs
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// TestPKCS11Key runs against SoftHSM, it is skipped unless SOFTHSM2_MODULE is set to the path of
+// libsofthsm2.so and softhsm2-util is in the PATH
+func TestPKCS11Key(t *testing.T) {
+	module := os.Getenv("SOFTHSM2_MODULE")
+	if len(module) == 0 {
+		t.Skip("SOFTHSM2_MODULE not set")
+	}
+	dir, err := ioutil.TempDir("", "softhsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokens := filepath.Join(dir, "tokens")
+	os.Mkdir(tokens, 0700)
+	conf := writeTempFile(t, dir, "softhsm2.conf", fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\n", tokens))
+	defer os.Setenv("SOFTHSM2_CONF", os.Getenv("SOFTHSM2_CONF"))
+	os.Setenv("SOFTHSM2_CONF", conf)
+	out, err := exec.Command("softhsm2-util", "--init-token", "--free", "--label", "goagent", "--pin", "1234", "--so-pin", "5678").CombinedOutput()
+	if err != nil {
+		t.Fatalf("softhsm2-util: %s\n%s", err.Error(), out)
+	}
+
+	p := PKCS11Config{ModulePath: module, TokenLabel: "goagent", Pin: "1234", KeyLabel: "device", KeyID: "01"}
+	ctx, err := p.context()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ctx.GenerateECDSAKeyPairWithLabel([]byte{1}, []byte("device"), elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "thing"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := writeTempFile(t, dir, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+
+	tlsConfig, err := NewTLSConfigWithKey(certPath, certPath, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tlsConfig.Certificates[0].PrivateKey.(crypto11.Signer); !ok {
+		t.Errorf("expected the key to stay in the token, got %T", tlsConfig.Certificates[0].PrivateKey)
+	}
+
+	p.KeyLabel, p.KeyID = "missing", ""
+	if _, err := NewTLSConfigWithKey(certPath, certPath, p); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+}
@@ -0,0 +1,194 @@
+package awsiotjobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// The MQTT APIs of fleet provisioning, see https://docs.aws.amazon.com/iot/latest/developerguide/fleet-provision-api.html
+const (
+	createCertificateTopic = "$aws/certificates/create/json"
+	registerThingTopic     = "$aws/provisioning-templates/%s/provision/json"
+)
+
+// provisioningTimeout is how long Provision waits for each response when ctx has no deadline
+var provisioningTimeout = 30 * time.Second
+
+// ProvisioningError is returned when AWS IoT rejects a fleet provisioning request
+type ProvisioningError struct {
+	Topic        string
+	StatusCode   int    `json:"statusCode"`
+	ErrorCode    string `json:"errorCode"`
+	ErrorMessage string `json:"errorMessage"`
+}
+
+func (err *ProvisioningError) Error() string {
+	return fmt.Sprintf("awsiotjobs: %s rejected with status %d, code %s: %s", err.Topic, err.StatusCode, err.ErrorCode, err.ErrorMessage)
+}
+
+// Internal types used to encode the requests and decode the responses
+type createCertificateResponse struct {
+	CertificateID             string `json:"certificateId"`
+	CertificatePem            string `json:"certificatePem"`
+	PrivateKey                string `json:"privateKey"`
+	CertificateOwnershipToken string `json:"certificateOwnershipToken"`
+}
+
+type registerThingRequest struct {
+	CertificateOwnershipToken string            `json:"certificateOwnershipToken"`
+	Parameters                map[string]string `json:"parameters,omitempty"`
+}
+
+type registerThingResponse struct {
+	DeviceConfiguration map[string]string `json:"deviceConfiguration"`
+	ThingName           string            `json:"thingName"`
+}
+
+// NeedsProvisioning tells whether fleet provisioning is enabled and the device certificate has not been issued yet
+func (c Config) NeedsProvisioning() bool {
+	if len(c.Provisioning.TemplateName) == 0 {
+		return false
+	}
+	_, err := os.Stat(c.CertificatePath)
+	return os.IsNotExist(err)
+}
+
+// claimConfig returns the configuration connecting with the claim certificate
+func (c Config) claimConfig() Config {
+	claim := c
+	claim.CertificatePath = c.Provisioning.ClaimCertificatePath
+	claim.PrivateKeyPath = c.Provisioning.ClaimPrivateKeyPath
+	claim.KeyProvider = "file"
+	if !isConfigured(claim.ClientID) {
+		claim.ClientID = "provisioning-" + newClientToken()
+	}
+	return claim
+}
+
+// isConfigured tells whether a setting is set to something else than a placeholder of the sample configuration
+func isConfigured(value string) bool {
+	return len(value) > 0 && !strings.HasPrefix(value, "<")
+}
+
+/*
+Provision obtains the device certificate with fleet provisioning by claim: it connects with the claim
+certificate, creates a new certificate and private key with $aws/certificates/create and registers the thing
+with the provisioning template Provisioning.TemplateName, passing Provisioning.Parameters.
+The private key and the certificate are written to PrivateKeyPath and CertificatePath, and the thing name
+returned by the template to Provisioning.ConfigFile, together with the client ID if none is configured, so
+that they are loaded as a drop-in from then on. The certificate is written last: until it exists,
+NeedsProvisioning is true and the whole process starts again.
+Provision returns c with the thing name and the client ID, ready for NewClient.
+A rejected request is reported as a *ProvisioningError.
+*/
+func Provision(ctx context.Context, c Config) (Config, error) {
+	claim := c.claimConfig()
+	logger := c.logger()
+	iot, err := newMqttClient(claim, func(mqtt.Client, error) {})
+	if err != nil {
+		return c, err
+	}
+	logger.Info("Provisioning - Connecting with the claim certificate", F("certificate", claim.CertificatePath))
+	if token := iot.Connect(); token.Wait() && token.Error() != nil {
+		return c, &ConnectError{broker(claim), token.Error()}
+	}
+	defer iot.Disconnect(250)
+
+	var keys createCertificateResponse
+	if err := provisioningRequest(ctx, iot, createCertificateTopic, struct{}{}, &keys); err != nil {
+		return c, err
+	}
+	logger.Info("Provisioning - Created the certificate", F("certificateId", keys.CertificateID))
+	var thing registerThingResponse
+	request := registerThingRequest{keys.CertificateOwnershipToken, c.Provisioning.Parameters}
+	if err := provisioningRequest(ctx, iot, fmt.Sprintf(registerThingTopic, c.Provisioning.TemplateName), request, &thing); err != nil {
+		return c, err
+	}
+	if len(thing.ThingName) == 0 {
+		return c, fmt.Errorf("awsiotjobs: the provisioning template %s did not return a thing name", c.Provisioning.TemplateName)
+	}
+	logger.Info("Provisioning - Registered the thing", F("thingName", thing.ThingName), F("deviceConfiguration", thing.DeviceConfiguration))
+
+	provisioned := map[string]string{"ThingName": thing.ThingName}
+	c.ThingName = thing.ThingName
+	if !isConfigured(c.ClientID) {
+		c.ClientID = thing.ThingName
+		provisioned["ClientID"] = thing.ThingName
+	}
+	if err := saveProvisioning(c, keys, provisioned); err != nil {
+		return c, err
+	}
+	logger.Info("Provisioning - Done")
+	return c, nil
+}
+
+// saveProvisioning writes the private key, the drop-in with the provisioned settings and finally the certificate
+func saveProvisioning(c Config, keys createCertificateResponse, provisioned map[string]string) error {
+	dropIn, _ := json.MarshalIndent(provisioned, "", "\t")
+	files := []struct {
+		path string
+		data []byte
+		perm os.FileMode
+	}{
+		{c.PrivateKeyPath, []byte(keys.PrivateKey), 0600},
+		{c.Provisioning.ConfigFile, dropIn, 0644},
+		{c.CertificatePath, []byte(keys.CertificatePem), 0644},
+	}
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(f.path, f.data, f.perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// provisioningRequest publishes the payload on topic and decodes the response of the accepted topic into
+// result. These APIs have no clientToken, so the responses are received on dedicated subscriptions.
+func provisioningRequest(ctx context.Context, iot IMqttClient, topic string, payload interface{}, result interface{}) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, provisioningTimeout)
+		defer cancel()
+	}
+	accepted, rejected := make(chan []byte, 1), make(chan []byte, 1)
+	handler := func(ch chan []byte) mqtt.MessageHandler {
+		return func(_ mqtt.Client, msg mqtt.Message) {
+			select {
+			case ch <- msg.Payload():
+			default:
+			}
+		}
+	}
+	// AWS IoT does not keep the responses, the subscriptions must be in place before publishing
+	for suffix, ch := range map[string]chan []byte{"/accepted": accepted, "/rejected": rejected} {
+		if t := iot.Subscribe(topic+suffix, 1, handler(ch)); t.Wait() && t.Error() != nil {
+			return t.Error()
+		}
+	}
+	defer iot.Unsubscribe(topic+"/accepted", topic+"/rejected")
+
+	jsonPayload, _ := json.Marshal(payload)
+	if t := iot.Publish(topic, 1, false, jsonPayload); t.WaitTimeout(publishTimeout) && t.Error() != nil {
+		return t.Error()
+	}
+	select {
+	case msg := <-accepted:
+		return json.Unmarshal(msg, result)
+	case msg := <-rejected:
+		err := &ProvisioningError{Topic: topic}
+		json.Unmarshal(msg, err)
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("awsiotjobs: waiting for the response on %s: %w", topic, ctx.Err())
+	}
+}
@@ -0,0 +1,147 @@
+package awsiotjobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// newProvisioningConfig returns a configuration to provision with the template "fleet" into dir
+func newProvisioningConfig(dir string) Config {
+	c := NewConfig()
+	c.CertificatePath = filepath.Join(dir, "cert.pem")
+	c.PrivateKeyPath = filepath.Join(dir, "private.key")
+	c.ClientID = "<CLIENT_ID>"
+	c.Provisioning = ProvisioningConfig{
+		TemplateName:         "fleet",
+		ClaimCertificatePath: filepath.Join(dir, "claim.pem"),
+		ClaimPrivateKeyPath:  filepath.Join(dir, "claim.key"),
+		Parameters:           map[string]string{"SerialNumber": "1234"},
+		ConfigFile:           filepath.Join(dir, "conf.d", "90-provisioning.json"),
+	}
+	return c
+}
+
+func TestProvision(t *testing.T) {
+	defer func(f func(Config, mqtt.ConnectionLostHandler) (IMqttClient, error)) { newMqttClient = f }(newMqttClient)
+	dir, err := ioutil.TempDir("", "provisioning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := newProvisioningConfig(dir)
+	if !c.NeedsProvisioning() {
+		t.Fatal("expected provisioning to be needed without a certificate")
+	}
+
+	iot := newFakeMqtt()
+	var claim Config
+	newMqttClient = func(c Config, onLost mqtt.ConnectionLostHandler) (IMqttClient, error) {
+		claim = c
+		return iot, nil
+	}
+	iot.onPublish = func(topic string, payload []byte) {
+		switch topic {
+		case "$aws/certificates/create/json":
+			iot.deliver(topic+"/accepted", createCertificateResponse{"cert-id", "CERTIFICATE", "KEY", "ownership"})
+		case "$aws/provisioning-templates/fleet/provision/json":
+			var request registerThingRequest
+			json.Unmarshal(payload, &request)
+			if request.CertificateOwnershipToken != "ownership" || request.Parameters["SerialNumber"] != "1234" {
+				t.Errorf("unexpected register request %s", payload)
+			}
+			iot.deliver(topic+"/accepted", registerThingResponse{ThingName: "device-1234"})
+		}
+	}
+
+	provisioned, err := Provision(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claim.CertificatePath != c.Provisioning.ClaimCertificatePath || claim.PrivateKeyPath != c.Provisioning.ClaimPrivateKeyPath {
+		t.Errorf("expected to connect with the claim certificate, got %s and %s", claim.CertificatePath, claim.PrivateKeyPath)
+	}
+	if provisioned.ThingName != "device-1234" || provisioned.ClientID != "device-1234" {
+		t.Errorf("expected the thing name and client ID of the template, got %s and %s", provisioned.ThingName, provisioned.ClientID)
+	}
+	for path, expected := range map[string]string{c.CertificatePath: "CERTIFICATE", c.PrivateKeyPath: "KEY"} {
+		if b, err := ioutil.ReadFile(path); err != nil || string(b) != expected {
+			t.Errorf("%s: expected %s, got %s, %v", path, expected, b, err)
+		}
+	}
+	if info, err := os.Stat(c.PrivateKeyPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the private key to be readable only by its owner, got %v, %v", info.Mode(), err)
+	}
+
+	loader := ConfigLoader{Defaults: c, DropInDir: filepath.Dir(c.Provisioning.ConfigFile)}
+	loaded, _, err := loader.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ThingName != "device-1234" || loaded.ClientID != "device-1234" {
+		t.Errorf("expected the drop-in to set the thing name and client ID, got %s and %s", loaded.ThingName, loaded.ClientID)
+	}
+	if loaded.NeedsProvisioning() {
+		t.Error("expected provisioning not to be needed once the certificate is written")
+	}
+	if len(iot.subscriptions) != 0 {
+		t.Errorf("expected the provisioning topics to be unsubscribed, got %v", iot.subscriptions)
+	}
+}
+
+func TestProvisionRejected(t *testing.T) {
+	defer func(f func(Config, mqtt.ConnectionLostHandler) (IMqttClient, error)) { newMqttClient = f }(newMqttClient)
+	dir, err := ioutil.TempDir("", "provisioning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := newProvisioningConfig(dir)
+
+	iot := newFakeMqtt()
+	newMqttClient = func(c Config, onLost mqtt.ConnectionLostHandler) (IMqttClient, error) { return iot, nil }
+	iot.onPublish = func(topic string, payload []byte) {
+		switch topic {
+		case "$aws/certificates/create/json":
+			iot.deliver(topic+"/accepted", createCertificateResponse{"cert-id", "CERTIFICATE", "KEY", "ownership"})
+		case "$aws/provisioning-templates/fleet/provision/json":
+			iot.deliver(topic+"/rejected", map[string]interface{}{
+				"statusCode": 400, "errorCode": "InvalidParameters", "errorMessage": "SerialNumber is not allowed",
+			})
+		}
+	}
+
+	var provisioningError *ProvisioningError
+	if _, err := Provision(context.Background(), c); !errors.As(err, &provisioningError) || provisioningError.ErrorCode != "InvalidParameters" {
+		t.Fatalf("expected a ProvisioningError, got %v", err)
+	}
+	if !c.NeedsProvisioning() {
+		t.Error("expected provisioning to be needed again after a rejection")
+	}
+}
+
+func TestValidateProvisioning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "provisioning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := newProvisioningConfig(dir)
+	c.Endpoint = "abc123-ats.iot.eu-west-1.amazonaws.com"
+	c.CaCertPath = writeTempFile(t, dir, "rootCA.pem", "CA")
+	c.ThingName = "<THING_NAME>"
+	if err := c.Validate(); err == nil {
+		t.Error("expected the missing claim certificate to be reported")
+	}
+	writeTempFile(t, dir, "claim.pem", "CLAIM")
+	writeTempFile(t, dir, "claim.key", "KEY")
+	if err := c.Validate(); err != nil {
+		t.Errorf("expected the thing name and the certificate to be optional before provisioning, got %s", err.Error())
+	}
+}
@@ -0,0 +1,109 @@
+package awsiotjobs
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// proxyURL returns the proxy to reach the endpoint of c: Config.Proxy if set, otherwise the one of the
+// HTTPS_PROXY and NO_PROXY environment variables. It returns nil to connect directly.
+func proxyURL(c Config) (*url.URL, error) {
+	if len(c.Proxy) > 0 {
+		return url.Parse(c.Proxy)
+	}
+	return httpproxy.FromEnvironment().ProxyFunc()(&url.URL{Scheme: "https", Host: c.Endpoint})
+}
+
+// dialProxy opens a connection to addr through an HTTP proxy, with the CONNECT method, or a SOCKS5 proxy
+func dialProxy(proxyURL *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		socks, err := proxy.FromURL(proxyURL, dialer)
+		if err != nil {
+			return nil, err
+		}
+		return socks.Dial("tcp", addr)
+	case "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme \"%s\"", proxyURL.Scheme)
+	}
+
+	proxyAddr := proxyURL.Host
+	if len(proxyURL.Port()) == 0 {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	conn, err := dialer.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	conn.SetDeadline(deadline(timeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The broker does not send anything before the TLS handshake, so the reader cannot consume more than the response
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: CONNECT %s: %s", proxyURL.Host, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// deadline returns the time after timeout, or no deadline if timeout is 0
+func deadline(timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// openProxiedTLSConnection returns a paho OpenConnectionFunc connecting to the broker with TLS through the proxy
+func openProxiedTLSConnection(proxyURL *url.URL, tlsConfig *tls.Config) mqtt.OpenConnectionFunc {
+	return func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+		conn, err := dialProxy(proxyURL, uri.Host, options.ConnectTimeout)
+		if err != nil {
+			return nil, err
+		}
+		config := tlsConfig.Clone()
+		if len(config.ServerName) == 0 {
+			config.ServerName = uri.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		tlsConn.SetDeadline(deadline(options.ConnectTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}
+}
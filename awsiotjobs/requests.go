@@ -0,0 +1,207 @@
+package awsiotjobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// defaultRequestTimeout is applied to requests whose context has no deadline
+const defaultRequestTimeout = 10 * time.Second
+
+// JobExecutionSummary is the summary of a pending job execution returned by GetPendingJobs
+type JobExecutionSummary struct {
+	JobID           string `json:"jobId"`
+	QueuedAt        int64  `json:"queuedAt"`
+	StartedAt       int64  `json:"startedAt"`
+	LastUpdatedAt   int64  `json:"lastUpdatedAt"`
+	VersionNumber   int64  `json:"versionNumber"`
+	ExecutionNumber int64  `json:"executionNumber"`
+}
+
+// PendingJobs is the list of job executions for the thing which are not in a terminal state
+type PendingJobs struct {
+	InProgressJobs []JobExecutionSummary `json:"inProgressJobs"`
+	QueuedJobs     []JobExecutionSummary `json:"queuedJobs"`
+}
+
+type response struct {
+	payload []byte
+	err     error
+}
+
+// requests keeps track of the requests waiting for a response, by clientToken
+type requests struct {
+	pending  map[string]chan response
+	inFlight sync.WaitGroup
+	mux      sync.Mutex
+}
+
+func newRequests() *requests {
+	return &requests{pending: make(map[string]chan response)}
+}
+
+func (r *requests) add(token string) chan response {
+	ch := make(chan response, 1)
+	r.inFlight.Add(1)
+	r.mux.Lock()
+	r.pending[token] = ch
+	r.mux.Unlock()
+	return ch
+}
+
+func (r *requests) len() int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return len(r.pending)
+}
+
+// remove must be called once for every add, when the request is completed
+func (r *requests) remove(token string) {
+	r.mux.Lock()
+	delete(r.pending, token)
+	r.mux.Unlock()
+	r.inFlight.Done()
+}
+
+// wait blocks until there are no requests in flight or ctx is done
+func (r *requests) wait(ctx context.Context) error {
+	return waitContext(ctx, &r.inFlight)
+}
+
+// waitContext waits for wg, giving up when ctx is done
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deliver hands the response to the request waiting for token, and returns false if there is none
+func (r *requests) deliver(token string, resp response) bool {
+	r.mux.Lock()
+	ch, ok := r.pending[token]
+	delete(r.pending, token)
+	r.mux.Unlock()
+	if ok {
+		ch <- resp
+	}
+	return ok
+}
+
+// newClientToken returns a random token, well within the 64 characters allowed by AWS IoT Jobs
+func newClientToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Internal types used to decode the responses
+type responseHeader struct {
+	ClientToken string `json:"clientToken"`
+}
+
+type errorResponse struct {
+	ClientToken string `json:"clientToken"`
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+}
+
+// request publishes the payload on topic adding a clientToken, and waits for the response with
+// the same clientToken on the accepted or rejected topic. A rejection is returned as a JobError.
+func (client *Client) request(ctx context.Context, topic string, payload map[string]interface{}) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultRequestTimeout)
+		defer cancel()
+	}
+	token := newClientToken()
+	payload["clientToken"] = token
+	jsonPayload, _ := json.Marshal(payload)
+
+	ch := client.requests.add(token)
+	defer client.requests.remove(token)
+	t := client.mqttPublish(topic, 1, jsonPayload)
+	if t.WaitTimeout(publishTimeout) && t.Error() != nil {
+		return nil, t.Error()
+	}
+	select {
+	case resp := <-ch:
+		return resp.payload, resp.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// acceptedHandler delivers the response to the pending request, if any, and returns false otherwise
+func (client *Client) acceptedHandler(msg mqtt.Message) bool {
+	var header responseHeader
+	json.Unmarshal(msg.Payload(), &header)
+	if len(header.ClientToken) == 0 {
+		return false
+	}
+	return client.requests.deliver(header.ClientToken, response{payload: msg.Payload()})
+}
+
+func (client *Client) rejectedHandler(mqttClient mqtt.Client, msg mqtt.Message) {
+	var resp errorResponse
+	json.Unmarshal(msg.Payload(), &resp)
+	err := JobError{ErrCode: resp.Code, ErrMessage: resp.Message}
+	if len(resp.ClientToken) == 0 || !client.requests.deliver(resp.ClientToken, response{err: err}) {
+		client.defaultHandler(mqttClient, msg)
+	}
+}
+
+func (client *Client) getAcceptedHandler(mqttClient mqtt.Client, msg mqtt.Message) {
+	if !client.acceptedHandler(msg) {
+		client.jobHandler(mqttClient, msg)
+	}
+}
+
+func (client *Client) responseHandler(mqttClient mqtt.Client, msg mqtt.Message) {
+	if !client.acceptedHandler(msg) {
+		client.defaultHandler(mqttClient, msg)
+	}
+}
+
+// GetPendingJobs returns the job executions for the thing which are not in a terminal state
+func (client *Client) GetPendingJobs(ctx context.Context) (PendingJobs, error) {
+	var pending PendingJobs
+	topic := fmt.Sprintf(jobBaseTopic, client.getConfig().ThingName, "get")
+	payload, err := client.request(ctx, topic, map[string]interface{}{})
+	if err != nil {
+		return pending, err
+	}
+	err = json.Unmarshal(payload, &pending)
+	return pending, err
+}
+
+// DescribeJobExecution returns the current state of the execution of jobID, including the job document.
+// The returned JobExecution can be used to update the execution status.
+func (client *Client) DescribeJobExecution(ctx context.Context, jobID string) (*JobExecution, error) {
+	topic := fmt.Sprintf("%s/get", fmt.Sprintf(jobBaseTopic, client.getConfig().ThingName, jobID))
+	payload, err := client.request(ctx, topic, map[string]interface{}{"includeJobDocument": true})
+	if err != nil {
+		return nil, err
+	}
+	jobExecution, err := parseJobMessage(payload)
+	if err != nil {
+		return nil, err
+	}
+	jobExecution.client = client
+	jobExecution.ThingName = client.getConfig().ThingName
+	return jobExecution, nil
+}
@@ -0,0 +1,211 @@
+package awsiotjobs
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeToken is complete, unless timeout is set: it then never completes, as when AWS IoT does not answer
+type fakeToken struct {
+	err     error
+	timeout bool
+}
+
+func (t *fakeToken) Wait() bool                     { return !t.timeout }
+func (t *fakeToken) WaitTimeout(time.Duration) bool { return !t.timeout }
+func (t *fakeToken) Error() error                   { return t.err }
+
+func (t *fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	if !t.timeout {
+		close(done)
+	}
+	return done
+}
+
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return 0 }
+func (m *fakeMessage) Retained() bool    { return false }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return 0 }
+func (m *fakeMessage) Payload() []byte   { return m.payload }
+func (m *fakeMessage) Ack()              {}
+
+// fakeMqtt is an in memory IMqttClient. onPublish is invoked for every publish, and can
+// answer by calling deliver.
+type fakeMqtt struct {
+	subscriptions map[string]mqtt.MessageHandler
+	onPublish     func(topic string, payload []byte)
+	connectErrors []error // returned by the next calls to Connect
+	publishError  error   // returned by Publish while set, as when the connection is down
+	noSuback      bool    // when set, the subscriptions are never acknowledged
+	published     []string
+	connects      int // calls to Connect
+	mux           sync.Mutex
+}
+
+func newFakeMqtt() *fakeMqtt {
+	return &fakeMqtt{subscriptions: make(map[string]mqtt.MessageHandler)}
+}
+
+func (f *fakeMqtt) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var b []byte
+	switch p := payload.(type) {
+	case []byte:
+		b = p
+	case string:
+		b = []byte(p)
+	}
+	f.mux.Lock()
+	err := f.publishError
+	if err == nil {
+		f.published = append(f.published, topic)
+	}
+	f.mux.Unlock()
+	if err != nil {
+		return &fakeToken{err: err}
+	}
+	if f.onPublish != nil {
+		go f.onPublish(topic, b)
+	}
+	return &fakeToken{}
+}
+
+func (f *fakeMqtt) Subscribe(topic string, qos byte, handler mqtt.MessageHandler) mqtt.Token {
+	f.mux.Lock()
+	f.subscriptions[topic] = handler
+	timeout := f.noSuback
+	f.mux.Unlock()
+	return &fakeToken{timeout: timeout}
+}
+
+func (f *fakeMqtt) Unsubscribe(topics ...string) mqtt.Token {
+	f.mux.Lock()
+	for _, topic := range topics {
+		delete(f.subscriptions, topic)
+	}
+	f.mux.Unlock()
+	return &fakeToken{}
+}
+
+func (f *fakeMqtt) Connect() mqtt.Token {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.connects++
+	if len(f.connectErrors) > 0 {
+		err := f.connectErrors[0]
+		f.connectErrors = f.connectErrors[1:]
+		return &fakeToken{err: err}
+	}
+	return &fakeToken{}
+}
+
+func (f *fakeMqtt) Disconnect(quiesce uint) {}
+
+func matchTopic(filter, topic string) bool {
+	fs, ts := strings.Split(filter, "/"), strings.Split(topic, "/")
+	if len(fs) != len(ts) {
+		return false
+	}
+	for i := range fs {
+		if fs[i] != "+" && fs[i] != ts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// deliver sends the message to the handlers of the matching subscriptions
+func (f *fakeMqtt) deliver(topic string, payload interface{}) {
+	b, _ := json.Marshal(payload)
+	f.mux.Lock()
+	var handlers []mqtt.MessageHandler
+	for filter, handler := range f.subscriptions {
+		if matchTopic(filter, topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	f.mux.Unlock()
+	for _, handler := range handlers {
+		handler(nil, &fakeMessage{topic: topic, payload: b})
+	}
+}
+
+func clientToken(payload []byte) string {
+	var header responseHeader
+	json.Unmarshal(payload, &header)
+	return header.ClientToken
+}
+
+func newTestClient(iot *fakeMqtt) *Client {
+	client := &Client{Iot: iot, config: Config{ThingName: "thing"}, requests: newRequests(), executions: newExecutions()}
+	client.subscribe()
+	return client
+}
+
+func TestGetPendingJobs(t *testing.T) {
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	iot.onPublish = func(topic string, payload []byte) {
+		if topic != "$aws/things/thing/jobs/get" {
+			return
+		}
+		// A response for somebody else must be ignored
+		iot.deliver(topic+"/accepted", map[string]interface{}{"clientToken": "other"})
+		iot.deliver(topic+"/accepted", map[string]interface{}{
+			"clientToken":    clientToken(payload),
+			"inProgressJobs": []map[string]interface{}{{"jobId": "job1", "versionNumber": 2}},
+			"queuedJobs":     []map[string]interface{}{{"jobId": "job2"}},
+		})
+	}
+
+	pending, err := client.GetPendingJobs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending.InProgressJobs) != 1 || pending.InProgressJobs[0].JobID != "job1" ||
+		pending.InProgressJobs[0].VersionNumber != 2 || len(pending.QueuedJobs) != 1 {
+		t.Errorf("unexpected pending jobs %v", pending)
+	}
+}
+
+func TestDescribeJobExecutionRejected(t *testing.T) {
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	iot.onPublish = func(topic string, payload []byte) {
+		iot.deliver(topic+"/rejected", map[string]interface{}{
+			"clientToken": clientToken(payload),
+			"code":        "ResourceNotFound",
+			"message":     "not found",
+		})
+	}
+
+	_, err := client.DescribeJobExecution(context.Background(), "job1")
+	jobError, ok := err.(JobError)
+	if !ok || jobError.ErrCode != "ResourceNotFound" {
+		t.Errorf("expected ResourceNotFound JobError, got %v", err)
+	}
+}
+
+func TestDescribeJobExecutionTimeout(t *testing.T) {
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.DescribeJobExecution(ctx, "job1")
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package awsiotjobs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// HandlerFunc is the signature of a job handler, see Config.Handler
+type HandlerFunc func(ctx context.Context, je JobExecutioner)
+
+// Router dispatches job executions to the handler registered for the "operation" field of
+// the job document. This allows a single agent to handle different kinds of jobs.
+//
+//	router := awsiotjobs.NewRouter()
+//	router.Handle("mender_install", mender.Process)
+//	config.Handler = router.Process
+type Router struct {
+	handlers map[string]HandlerFunc
+	fallback HandlerFunc
+	mux      sync.RWMutex
+}
+
+// NewRouter returns an empty Router. Jobs are rejected until handlers are registered.
+func NewRouter() *Router {
+	return &Router{handlers: make(map[string]HandlerFunc)}
+}
+
+// Handle registers the handler for the given operation. Registering an operation twice panics,
+// since it is always a programming error.
+func (r *Router) Handle(operation string, handler HandlerFunc) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.handlers[operation]; ok {
+		panic(fmt.Sprintf("awsiotjobs: handler already registered for operation %s", operation))
+	}
+	r.handlers[operation] = handler
+}
+
+// Fallback sets the handler invoked for jobs whose operation has no registered handler.
+// Without a fallback such jobs are rejected.
+func (r *Router) Fallback(handler HandlerFunc) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.fallback = handler
+}
+
+// Process is the JobExecution handler, to be set as Config.Handler
+func (r *Router) Process(ctx context.Context, je JobExecutioner) {
+	operation, _ := je.GetJobDocument()["operation"].(string)
+	r.mux.RLock()
+	handler, ok := r.handlers[operation]
+	if !ok {
+		handler = r.fallback
+	}
+	r.mux.RUnlock()
+	if handler == nil {
+		je.GetLogger().Warn("No handler for the operation - Rejecting", F("operation", operation))
+		err := je.Reject(JobError{ErrCode: "ERR_JOB_INVALID_OPERATION", ErrMessage: "unrecognized or missing operation"})
+		if err != nil && err != ErrQueued {
+			je.GetLogger().Error("Failed to reject the job", F("error", err))
+		}
+		return
+	}
+	handler(ctx, je)
+}
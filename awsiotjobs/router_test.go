@@ -0,0 +1,60 @@
+package awsiotjobs
+
+import (
+	"context"
+	"testing"
+)
+
+type fakeExecution struct {
+	JobExecutioner
+	doc      JobDocument
+	rejected *JobError
+}
+
+func (f *fakeExecution) GetJobDocument() JobDocument {
+	return f.doc
+}
+
+func (f *fakeExecution) GetLogger() Logger {
+	return testLogger
+}
+
+func (f *fakeExecution) Reject(err JobError) error {
+	f.rejected = &err
+	return nil
+}
+
+func TestRouterDispatch(t *testing.T) {
+	var got string
+	router := NewRouter()
+	router.Handle("install", func(ctx context.Context, je JobExecutioner) { got = "install" })
+	router.Handle("diagnostics", func(ctx context.Context, je JobExecutioner) { got = "diagnostics" })
+
+	router.Process(context.Background(), &fakeExecution{doc: JobDocument{"operation": "diagnostics"}})
+	if got != "diagnostics" {
+		t.Errorf("wanted diagnostics handler, got \"%s\"", got)
+	}
+}
+
+func TestRouterRejectsUnknownOperation(t *testing.T) {
+	router := NewRouter()
+	router.Handle("install", func(ctx context.Context, je JobExecutioner) { t.Error("unexpected call to install handler") })
+
+	je := &fakeExecution{doc: JobDocument{"operation": "reboot"}}
+	router.Process(context.Background(), je)
+	if je.rejected == nil || je.rejected.ErrCode != "ERR_JOB_INVALID_OPERATION" {
+		t.Errorf("expected job to be rejected, got %v", je.rejected)
+	}
+}
+
+func TestRouterFallback(t *testing.T) {
+	called := false
+	router := NewRouter()
+	router.Fallback(func(ctx context.Context, je JobExecutioner) { called = true })
+
+	je := &fakeExecution{doc: JobDocument{}}
+	router.Process(context.Background(), je)
+	if !called || je.rejected != nil {
+		t.Errorf("expected fallback to handle the job, called: %v, rejected: %v", called, je.rejected)
+	}
+}
@@ -0,0 +1,241 @@
+package awsiotjobs
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// defaultTelemetryInterval is the default of Config.TelemetryInterval
+const defaultTelemetryInterval = 5 * time.Minute
+
+// Stats describes the health of the connection to AWS IoT and counts the jobs. It is returned by Client.Stats
+// and published on Config.TelemetryTopic. The times are Unix timestamps, 0 when the event never happened.
+type Stats struct {
+	ThingName   string `json:"thingName"`
+	Connected   bool   `json:"connected"`
+	ConnectedAt int64  `json:"connectedAt"`
+	// Connects counts the successful connections, Reconnects the ones after the first
+	Connects        int64 `json:"connects"`
+	Reconnects      int64 `json:"reconnects"`
+	ConnectFailures int64 `json:"connectFailures"`
+	// Disconnects counts the connections lost, not the ones closed by the agent
+	Disconnects int64  `json:"disconnects"`
+	LastError   string `json:"lastError,omitempty"`
+	LastErrorAt int64  `json:"lastErrorAt"`
+	// Published counts the messages acknowledged, for QoS 1, or written, for QoS 0
+	Published       int64 `json:"published"`
+	PublishFailures int64 `json:"publishFailures"`
+	// PublishLatency is the mean time until a publish completes, MaxPublishLatency the longest and
+	// PublishLatencySum the total over the Published messages, in milliseconds
+	PublishLatency    float64 `json:"publishLatencyMs"`
+	MaxPublishLatency float64 `json:"maxPublishLatencyMs"`
+	PublishLatencySum float64 `json:"publishLatencySumMs"`
+	// PendingAcks counts the publishes not completed yet, PendingRequests the requests waiting for a response
+	PendingAcks     int64 `json:"pendingAcks"`
+	PendingRequests int   `json:"pendingRequests"`
+	// Queued counts the messages waiting in the outbox
+	Queued int `json:"queued"`
+	// JobsReceived counts the job executions handled, the others the final statuses reported
+	JobsReceived  int64 `json:"jobsReceived"`
+	JobsSucceeded int64 `json:"jobsSucceeded"`
+	JobsFailed    int64 `json:"jobsFailed"`
+	JobsRejected  int64 `json:"jobsRejected"`
+	Timestamp     int64 `json:"timestamp"`
+}
+
+// clientStats accumulates the events of the connection and of the jobs, the zero value is ready to use
+type clientStats struct {
+	connected       bool
+	connectedAt     time.Time
+	connects        int64
+	connectFailures int64
+	disconnects     int64
+	lastError       string
+	lastErrorAt     time.Time
+	published       int64
+	publishFailures int64
+	pendingAcks     int64
+	latencySum      time.Duration
+	latencyMax      time.Duration
+	jobsReceived    int64
+	jobsDone        map[string]int64 // by final status
+	mux             sync.Mutex
+}
+
+func (s *clientStats) setError(err error) {
+	s.lastError = err.Error()
+	s.lastErrorAt = time.Now()
+}
+
+func (s *clientStats) onConnect() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.connected = true
+	s.connectedAt = time.Now()
+	s.connects++
+}
+
+func (s *clientStats) onConnectError(err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.connectFailures++
+	s.setError(err)
+}
+
+// onConnectionLost is called when the connection drops, onDisconnect when the agent closes it
+func (s *clientStats) onConnectionLost(err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.connected = false
+	s.disconnects++
+	s.setError(err)
+}
+
+func (s *clientStats) onDisconnect() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.connected = false
+}
+
+// isConnected tells whether the client is connected, as far as it knows
+func (s *clientStats) isConnected() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.connected
+}
+
+func (s *clientStats) onPublish() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.pendingAcks++
+}
+
+func (s *clientStats) onPublishDone(latency time.Duration, err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.pendingAcks--
+	if err != nil {
+		s.publishFailures++
+		s.setError(err)
+		return
+	}
+	s.published++
+	s.latencySum += latency
+	if latency > s.latencyMax {
+		s.latencyMax = latency
+	}
+}
+
+func (s *clientStats) onJobReceived() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.jobsReceived++
+}
+
+func (s *clientStats) onJobDone(status string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.jobsDone == nil {
+		s.jobsDone = make(map[string]int64)
+	}
+	s.jobsDone[status]++
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (s *clientStats) snapshot() Stats {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	stats := Stats{
+		Connected:         s.connected,
+		Connects:          s.connects,
+		ConnectFailures:   s.connectFailures,
+		Disconnects:       s.disconnects,
+		LastError:         s.lastError,
+		LastErrorAt:       unixOrZero(s.lastErrorAt),
+		Published:         s.published,
+		PublishFailures:   s.publishFailures,
+		MaxPublishLatency: milliseconds(s.latencyMax),
+		PublishLatencySum: milliseconds(s.latencySum),
+		PendingAcks:       s.pendingAcks,
+		JobsReceived:      s.jobsReceived,
+		JobsSucceeded:     s.jobsDone["SUCCEEDED"],
+		JobsFailed:        s.jobsDone["FAILED"],
+		JobsRejected:      s.jobsDone["REJECTED"],
+	}
+	if s.connected {
+		stats.ConnectedAt = s.connectedAt.Unix()
+	}
+	if s.connects > 1 {
+		stats.Reconnects = s.connects - 1
+	}
+	if s.published > 0 {
+		stats.PublishLatency = milliseconds(s.latencySum / time.Duration(s.published))
+	}
+	return stats
+}
+
+// Stats returns the current health of the connection to AWS IoT
+func (client *Client) Stats() Stats {
+	stats := client.stats.snapshot()
+	stats.ThingName = client.getConfig().ThingName
+	stats.PendingRequests = client.requests.len()
+	stats.Queued = client.outbox.len()
+	stats.Timestamp = time.Now().Unix()
+	return stats
+}
+
+// mqttPublish publishes with the current MQTT client, recording the outcome and the latency in the stats
+func (client *Client) mqttPublish(topic string, qos byte, payload interface{}) mqtt.Token {
+	start := time.Now()
+	client.stats.onPublish()
+	t := client.iot().Publish(topic, qos, false, payload)
+	go func() {
+		<-t.Done()
+		client.stats.onPublishDone(time.Since(start), t.Error())
+	}()
+	return t
+}
+
+// publishStats publishes the Stats on Config.TelemetryTopic every Config.TelemetryInterval until ctx is done.
+// Nothing is published while disconnected, the stats of the period are in the next report.
+func (client *Client) publishStats(ctx context.Context) {
+	for {
+		c := client.getConfig()
+		interval := time.Duration(c.TelemetryInterval)
+		if interval <= 0 {
+			interval = defaultTelemetryInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if len(c.TelemetryTopic) == 0 {
+			continue // it can be set by Reconfigure
+		}
+		stats := client.Stats()
+		if !stats.Connected {
+			continue
+		}
+		payload, err := json.Marshal(stats)
+		if err != nil {
+			client.Logger().Error("Telemetry - Cannot encode the stats", F("error", err))
+			continue
+		}
+		client.mqttPublish(c.TelemetryTopic, 0, payload)
+	}
+}
@@ -0,0 +1,118 @@
+package awsiotjobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitStats polls the stats until ok returns true, or fails after a second
+func waitStats(t *testing.T, client *Client, ok func(Stats) bool) Stats {
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		stats := client.Stats()
+		if ok(stats) {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+	}
+}
+
+func TestStatsTrackConnection(t *testing.T) {
+	iot := newFakeMqtt()
+	iot.connectErrors = []error{errors.New("refused")}
+	client := newTestClient(iot)
+
+	if err := client.ConnectAndSubscribe(); err == nil {
+		t.Fatal("expected the first connection to fail")
+	}
+	stats := client.Stats()
+	if stats.Connected || stats.ConnectFailures != 1 || stats.LastError != "refused" || stats.LastErrorAt == 0 {
+		t.Errorf("expected the connection failure to be recorded, got %+v", stats)
+	}
+	if err := client.ConnectAndSubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	stats = client.Stats()
+	if !stats.Connected || stats.Connects != 1 || stats.Reconnects != 0 || stats.ConnectedAt == 0 {
+		t.Errorf("expected the connection to be recorded, got %+v", stats)
+	}
+
+	client.connectionLost(nil, errors.New("EOF"))
+	stats = waitStats(t, client, func(s Stats) bool { return s.Connected && s.Reconnects == 1 })
+	if stats.Disconnects != 1 || stats.LastError != "EOF" || stats.ThingName != "thing" {
+		t.Errorf("expected the connection loss to be recorded, got %+v", stats)
+	}
+}
+
+func TestStatsTrackPublishes(t *testing.T) {
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	client.mqttPublish("a", 1, "")
+	client.mqttPublish("b", 0, "")
+	iot.publishError = errors.New("not connected")
+	client.mqttPublish("c", 1, "")
+
+	stats := waitStats(t, client, func(s Stats) bool { return s.Published == 2 && s.PublishFailures == 1 })
+	if stats.PendingAcks != 0 || stats.MaxPublishLatency < stats.PublishLatency || stats.PublishLatencySum < stats.MaxPublishLatency {
+		t.Errorf("unexpected publish stats %+v", stats)
+	}
+}
+
+func TestPublishStats(t *testing.T) {
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	client.config.TelemetryTopic = "fleet/telemetry"
+	client.config.TelemetryInterval = Duration(time.Millisecond)
+	reports := make(chan Stats, 10)
+	iot.onPublish = func(topic string, payload []byte) {
+		if topic != "fleet/telemetry" {
+			return
+		}
+		var stats Stats
+		if err := json.Unmarshal(payload, &stats); err != nil {
+			t.Error(err)
+		}
+		reports <- stats
+	}
+	if err := client.ConnectAndSubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.publishStats(ctx)
+	select {
+	case stats := <-reports:
+		if stats.ThingName != "thing" || !stats.Connected || stats.Connects != 1 || stats.Timestamp == 0 {
+			t.Errorf("unexpected report %+v", stats)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the stats to be published")
+	}
+}
+
+func TestStatsCountJobs(t *testing.T) {
+	iot := newFakeMqtt()
+	client := newTestClient(iot)
+	iot.onPublish = func(topic string, payload []byte) {
+		iot.deliver(topic+"/accepted", map[string]interface{}{"clientToken": clientToken(payload)})
+	}
+	succeeded := &JobExecution{JobID: "job1", client: client}
+	rejected := &JobExecution{JobID: "job2", client: client}
+	client.executions.add(succeeded)
+	client.executions.add(rejected)
+	if err := succeeded.Success(StatusDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rejected.Reject(JobError{ErrCode: "ERR", ErrMessage: "invalid document"}); err != nil {
+		t.Fatal(err)
+	}
+	stats := client.Stats()
+	if stats.JobsSucceeded != 1 || stats.JobsRejected != 1 || stats.JobsFailed != 0 {
+		t.Errorf("expected the final statuses to be counted, got %+v", stats)
+	}
+}
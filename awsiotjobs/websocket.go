@@ -0,0 +1,162 @@
+package awsiotjobs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// The transports selected by Config.Transport
+const (
+	transportTLS       = "tls"
+	transportWebSocket = "websocket"
+)
+
+// sigV4Service is the service name AWS IoT expects in the signature of the WebSocket connections
+const sigV4Service = "iotdevicegateway"
+
+// presignExpiry is how long the signed URL can be used to connect
+const presignExpiry = 5 * time.Minute
+
+// The AWS IoT endpoints are <prefix>.iot.<region>.amazonaws.com, or .amazonaws.com.cn in China
+var endpointRegionRegexp = regexp.MustCompile(`\.iot\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// region returns AWS.Region, or the region of the endpoint if it is not set
+func (c Config) region() string {
+	if len(c.AWS.Region) > 0 {
+		return c.AWS.Region
+	}
+	if m := endpointRegionRegexp.FindStringSubmatch(c.Endpoint); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// awsEscape encodes s as required by SigV4, which differs from url.QueryEscape for the spaces
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+/*
+presignURL returns the WebSocket URL of the endpoint, signed with SigV4 using the AWS credentials of c as
+described in https://docs.aws.amazon.com/iot/latest/developerguide/protocols.html#mqtt-ws.
+The URL is only valid for presignExpiry, so a new one is needed for every connection.
+*/
+func presignURL(c Config, now time.Time) string {
+	host := c.Endpoint
+	if c.Port != 443 {
+		host = fmt.Sprintf("%s:%d", c.Endpoint, c.Port)
+	}
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", amzDate[:8], c.region(), sigV4Service)
+	query := fmt.Sprintf("X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=%s&X-Amz-Date=%s&X-Amz-Expires=%d&X-Amz-SignedHeaders=host",
+		awsEscape(c.AWS.AccessKeyID+"/"+scope), amzDate, int(presignExpiry/time.Second))
+
+	emptyPayloadHash := sha256.Sum256(nil)
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		"/mqtt",
+		query,
+		"host:" + host + "\n",
+		"host",
+		hex.EncodeToString(emptyPayloadHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.AWS.SecretAccessKey), amzDate[:8])
+	key = hmacSHA256(key, c.region())
+	key = hmacSHA256(key, sigV4Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	signed := fmt.Sprintf("wss://%s/mqtt?%s&X-Amz-Signature=%s", host, query, signature)
+	// AWS IoT expects the session token to be added after signing
+	if len(c.AWS.SessionToken) > 0 {
+		signed += "&X-Amz-Security-Token=" + awsEscape(c.AWS.SessionToken)
+	}
+	return signed
+}
+
+// webSocketClient is the MQTT client of the WebSocket transport. Paho would reuse the signed URL of the first
+// connection to reconnect, after the signature has expired: instead every Connect builds a new paho client
+// with a new signature, and the connection is restored by Client.connectionLost.
+type webSocketClient struct {
+	config    Config
+	tlsConfig *tls.Config
+	proxy     *url.URL
+	onLost    mqtt.ConnectionLostHandler
+	client    mqtt.Client
+	mux       sync.Mutex
+}
+
+func newWebSocketClient(c Config, tlsConfig *tls.Config, proxy *url.URL, onLost mqtt.ConnectionLostHandler) *webSocketClient {
+	w := &webSocketClient{config: c, tlsConfig: tlsConfig, proxy: proxy, onLost: onLost}
+	w.client = w.newClient()
+	return w
+}
+
+func (w *webSocketClient) newClient() mqtt.Client {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(presignURL(w.config, time.Now()))
+	opts.SetClientID(w.config.ClientID).SetTLSConfig(w.tlsConfig)
+	opts.SetDefaultPublishHandler(unexpectedMessage(w.config.logger()))
+	opts.SetAutoReconnect(false)
+	opts.SetConnectionLostHandler(w.onLost)
+	if w.proxy != nil {
+		opts.SetWebsocketOptions(&mqtt.WebsocketOptions{Proxy: http.ProxyURL(w.proxy)})
+	}
+	return mqtt.NewClient(opts)
+}
+
+func (w *webSocketClient) current() mqtt.Client {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.client
+}
+
+// Connect connects with a newly signed URL
+func (w *webSocketClient) Connect() mqtt.Token {
+	c := w.newClient()
+	w.mux.Lock()
+	w.client = c
+	w.mux.Unlock()
+	return c.Connect()
+}
+
+func (w *webSocketClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return w.current().Publish(topic, qos, retained, payload)
+}
+
+func (w *webSocketClient) Subscribe(topic string, qos byte, handler mqtt.MessageHandler) mqtt.Token {
+	return w.current().Subscribe(topic, qos, handler)
+}
+
+func (w *webSocketClient) Unsubscribe(topics ...string) mqtt.Token {
+	return w.current().Unsubscribe(topics...)
+}
+
+func (w *webSocketClient) Disconnect(quiesce uint) {
+	w.current().Disconnect(quiesce)
+}
@@ -3,7 +3,11 @@ module github.com/aws-samples/aws-iot-jobs-full-system-update/goagent
 go 1.15
 
 require (
-	github.com/eclipse/paho.mqtt.golang v1.2.0
+	github.com/BurntSushi/toml v0.3.1
+	github.com/ThalesIgnite/crypto11 v1.2.5
+	github.com/eclipse/paho.mqtt.golang v1.4.1 // v1.4 adds ClientOptions.CustomOpenConnectionFn, used to connect through a proxy
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
 	golang.org/x/tools/gopls v0.7.1 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
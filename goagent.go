@@ -1,38 +1,211 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"sync"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
 	"github.com/aws-samples/aws-iot-jobs-full-system-update/goagent/awsiotjobs"
 	"github.com/aws-samples/aws-iot-jobs-full-system-update/goagent/awsiotjobs/mender"
 )
 
+// exitConfig is the exit status for configuration errors (EX_CONFIG), goagent.service does not restart on it
+const exitConfig = 78
+
+// flagSettings maps the command line flags to the configuration settings they override
+var flagSettings = map[string]string{
+	"port":                 "Port",
+	"cacert":               "CaCertPath",
+	"cert":                 "CertificatePath",
+	"key":                  "PrivateKeyPath",
+	"keyProvider":          "KeyProvider",
+	"endpoint":             "Endpoint",
+	"transport":            "Transport",
+	"proxy":                "Proxy",
+	"thingName":            "ThingName",
+	"clientId":             "ClientID",
+	"stateDir":             "StateDir",
+	"shutdownTimeout":      "ShutdownTimeout",
+	"certCheckInterval":    "CertificateCheckInterval",
+	"certExpiryWarning":    "CertificateExpiryWarning",
+	"certReportTopic":      "CertificateReportTopic",
+	"telemetryTopic":       "TelemetryTopic",
+	"telemetryInterval":    "TelemetryInterval",
+	"metricsAddress":       "MetricsAddress",
+	"logLevel":             "LogLevel",
+	"logFormat":            "LogFormat",
+	"provisioningTemplate": "Provisioning.TemplateName",
+}
+
+var (
+	configFile = flag.String("config", "/etc/goagent/goagent.conf", "the configuration file. Inline properties will override config file settings")
+	dropInDir  = flag.String("confd", "/etc/goagent/conf.d", "the directory of the configuration drop-in files, applied after the configuration file")
+	showConfig = flag.Bool("showConfig", false, "print the configuration and where each setting comes from, then exit")
+)
+
+// provisioningDropIn is the drop-in where the settings obtained by fleet provisioning are written
+const provisioningDropIn = "90-provisioning.json"
+
+// loadConfig layers the defaults, the configuration file, the drop-ins, the GOAGENT_* environment variables
+// and the command line flags
+func loadConfig() (awsiotjobs.Config, awsiotjobs.Provenance, error) {
+	defaults := awsiotjobs.NewConfig()
+	defaults.Provisioning.ConfigFile = filepath.Join(*dropInDir, provisioningDropIn)
+	loader := awsiotjobs.ConfigLoader{
+		Defaults:     defaults,
+		File:         *configFile,
+		FileRequired: isFlagSet("config"),
+		DropInDir:    *dropInDir,
+		Environ:      os.Environ(),
+		EnvPrefix:    "GOAGENT_",
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if key, ok := flagSettings[f.Name]; ok {
+			loader.Override(key, f.Value.String(), "flag -"+f.Name)
+		}
+	})
+	return loader.Load()
+}
+
 func main() {
-	c := awsiotjobs.NewConfig()
-	configFile := ""
-	flag.IntVar(&c.Port, "port", 8883, "the port to use to connect")
-	flag.StringVar(&c.CaCertPath, "cacert", "rootCA.pem", "the CA cert path")
-	flag.StringVar(&c.CertificatePath, "cert", "cert.pem", "the device certificate path")
-	flag.StringVar(&c.PrivateKeyPath, "key", "private.key", "the private key path")
-	flag.StringVar(&c.Endpoint, "endpoint", "", "the endpoint path")
-	flag.StringVar(&c.ThingName, "thingName", "", "the thing name")
-	flag.StringVar(&c.ClientID, "clientId", "", "the client Id for the MQTT connection")
-	flag.StringVar(&configFile, "config", "/etc/goagent/goagent.conf", "the configuration file. Inline properties will override config file settings")
+	// The flags only record what is set on the command line, the values are applied by loadConfig
+	defaults := awsiotjobs.NewConfig()
+	flag.Int("port", defaults.Port, "the port to use to connect")
+	flag.String("cacert", defaults.CaCertPath, "the CA cert path")
+	flag.String("cert", defaults.CertificatePath, "the device certificate path")
+	flag.String("key", defaults.PrivateKeyPath, "the private key path")
+	flag.String("keyProvider", defaults.KeyProvider, "where the private key is kept: file or pkcs11")
+	flag.String("endpoint", defaults.Endpoint, "the endpoint path")
+	flag.String("transport", defaults.Transport, "how to connect: tls, or websocket with the AWS credentials")
+	flag.String("proxy", defaults.Proxy, "the http:// or socks5:// URL of the proxy to connect through")
+	flag.String("thingName", defaults.ThingName, "the thing name")
+	flag.String("clientId", defaults.ClientID, "the client Id for the MQTT connection")
+	flag.String("stateDir", defaults.StateDir, "the directory where the job execution state is persisted")
+	flag.Var(&defaults.ShutdownTimeout, "shutdownTimeout", "how long to wait for running jobs and pending status updates when stopping")
+	flag.Var(&defaults.CertificateCheckInterval, "certCheckInterval", "how often to check the certificate files for changes, 0 to disable")
+	flag.Var(&defaults.CertificateExpiryWarning, "certExpiryWarning", "how long before the certificate expires to start logging warnings")
+	flag.String("certReportTopic", defaults.CertificateReportTopic, "the MQTT topic where to publish the certificate expiry report")
+	flag.String("telemetryTopic", defaults.TelemetryTopic, "the MQTT topic where to publish the connection stats")
+	flag.Var(&defaults.TelemetryInterval, "telemetryInterval", "how often to publish the connection stats")
+	flag.String("metricsAddress", defaults.MetricsAddress, "the address where to serve the Prometheus metrics, like 127.0.0.1:9100")
+	flag.String("logLevel", defaults.LogLevel.String(), "the least severe level logged: debug, info, warn or error")
+	flag.String("logFormat", defaults.LogFormat, "how to write the log: text, json or journald, by default journald when running under systemd")
+	flag.String("provisioningTemplate", defaults.Provisioning.TemplateName, "the fleet provisioning template registering the thing on first boot")
 	flag.Parse()
 
-	if len(configFile) > 0 {
-		c.FromFile(configFile)
-		flag.Parse() // We execute this to override the settings read from the config file
+	c, provenance, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read the configuration: %s\n", err.Error())
+		os.Exit(exitConfig)
+	}
+	if *showConfig {
+		fmt.Print(provenance.Report(c))
+		return
+	}
+	if err := c.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(exitConfig)
+	}
+	logger := awsiotjobs.NewLogger(os.Stderr, c.LogFormat, c.LogLevel)
+	provenance.Log(logger, c)
+
+	// systemd stops the service with SIGTERM, which cancels the job handlers. The client then waits up to
+	// shutdownTimeout for them to complete and for the pending status updates before disconnecting.
+	// A second signal exits immediately.
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	// SIGHUP is caught from the start, its default action would kill the agent during the provisioning
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		sig := <-sigs
+		logger.Info("Shutting down", awsiotjobs.F("signal", sig))
+		cancel()
+		sig = <-sigs
+		logger.Warn("Exiting", awsiotjobs.F("signal", sig))
+		os.Exit(1)
+	}()
+
+	// On first boot, the device certificate is obtained with the claim certificate. A failure exits and
+	// systemd starts the provisioning again.
+	if c.NeedsProvisioning() {
+		if c, err = awsiotjobs.Provision(ctx, c); err != nil {
+			fatal(logger, "Provisioning failed", err)
+		}
+		if err := c.Validate(); err != nil {
+			fatal(logger, "Invalid provisioned configuration", err)
+		}
+	}
+	router := awsiotjobs.NewRouter()
+	mender.Register(router)
+	c.Handler = router.Process
+	awsJobsClient, err := awsiotjobs.NewClient(c)
+	if err != nil {
+		fatal(logger, "Cannot create the client", err)
 	}
-	c.Handler = mender.Process
-	awsJobsClient := awsiotjobs.NewClient(c)
-	fmt.Println("MenderAgent started")
-	awsJobsClient.ConnectAndSubscribe()
+	logger.Info("MenderAgent started", awsiotjobs.F("thingName", c.ThingName))
+	if len(c.MetricsAddress) > 0 {
+		go serveMetrics(ctx, c.MetricsAddress, awsJobsClient)
+	}
+
+	// systemctl reload goagent sends SIGHUP: the configuration is read again and the client reconnects with it.
+	// An invalid configuration is logged and the agent keeps running with the current one. A SIGHUP received
+	// while provisioning or creating the client is ignored.
+	select {
+	case <-hups:
+		logger.Info("Received hangup while starting - ignoring")
+	default:
+	}
+	go func() {
+		for range hups {
+			if ctx.Err() == nil { // not while shutting down
+				reload(awsJobsClient)
+			}
+		}
+	}()
+	if err := awsJobsClient.Run(ctx); err != nil {
+		fatal(awsJobsClient.Logger(), "Shutdown incomplete", err)
+	}
+}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	wg.Wait()
+// fatal logs err and exits with status 1, systemd then restarts the agent
+func fatal(logger awsiotjobs.Logger, msg string, err error) {
+	logger.Error(msg, awsiotjobs.F("error", err))
+	os.Exit(1)
+}
+
+// reload reads the configuration again and applies it to the client
+func reload(client *awsiotjobs.Client) {
+	logger := client.Logger()
+	logger.Info("Received hangup - reloading the configuration")
+	c, provenance, err := loadConfig()
+	if err != nil {
+		logger.Error("Cannot read the configuration - keeping the current one", awsiotjobs.F("error", err))
+		return
+	}
+	if err := c.Validate(); err != nil {
+		logger.Error("Invalid configuration - keeping the current one", awsiotjobs.F("error", err))
+		return
+	}
+	provenance.Log(logger, c)
+	if err := client.Reconfigure(c); err != nil {
+		logger.Error("Cannot apply the configuration", awsiotjobs.F("error", err))
+		return
+	}
+	client.Logger().Info("Configuration reloaded")
+}
 
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
@@ -2,32 +2,38 @@ package mendercmd
 
 import (
 	"bufio"
-	"fmt"
+	"context"
 	"os/exec"
 )
 
 // Commander interface represents a generic tool interface
 type Commander interface {
 	Commit() error
-	Install(url string, done chan error, progress chan string) error
+	// Install sends the output of mender on progress and the result on done. Cancelling ctx kills mender.
+	Install(ctx context.Context, url string, done chan error, progress chan string) error
 	Rollback() error
 }
 
 // MenderCommand serves as the implementation of the commander interface
 type MenderCommand struct {
+	// Output receives every line mender writes to its standard output, with the mender option run like
+	// "-install". The output is discarded if nil.
+	Output func(command, line string)
 }
 
-func execMender(done chan error, progress chan string, args ...string) error {
-	cmd := exec.Command("mender", args...)
+func (m *MenderCommand) execMender(ctx context.Context, done chan error, progress chan string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "mender", args...)
 	stdout, _ := cmd.StdoutPipe()
 	cmd.Start()
 	scanner := bufio.NewScanner(stdout)
 	for scanner.Scan() {
-		m := scanner.Text()
+		line := scanner.Text()
 		if progress != nil {
-			progress <- m
+			progress <- line
+		}
+		if m.Output != nil {
+			m.Output(args[0], line)
 		}
-		fmt.Println(m)
 	}
 	err := cmd.Wait()
 	if done != nil {
@@ -37,16 +43,16 @@ func execMender(done chan error, progress chan string, args ...string) error {
 }
 
 // Install runs the mender install
-func (m *MenderCommand) Install(url string, done chan error, progress chan string) error {
-	return execMender(done, progress, "-install", url)
+func (m *MenderCommand) Install(ctx context.Context, url string, done chan error, progress chan string) error {
+	return m.execMender(ctx, done, progress, "-install", url)
 }
 
 // Commit runs mender commit
 func (m *MenderCommand) Commit() error {
-	return execMender(nil, nil, "-commit")
+	return m.execMender(context.Background(), nil, nil, "-commit")
 }
 
 // Rollback runs mender rollback
 func (m *MenderCommand) Rollback() error {
-	return execMender(nil, nil, "-rollback")
+	return m.execMender(context.Background(), nil, nil, "-rollback")
 }
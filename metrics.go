@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws-samples/aws-iot-jobs-full-system-update/goagent/awsiotjobs"
+	"github.com/aws-samples/aws-iot-jobs-full-system-update/goagent/awsiotjobs/mender"
+)
+
+// sample is a value of a metric, labels are written as is, e.g. status="succeeded"
+type sample struct {
+	labels string
+	value  float64
+}
+
+// writeMetric writes a metric in the Prometheus text exposition format
+func writeMetric(w io.Writer, name, typ, help string, samples ...sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, s := range samples {
+		if len(s.labels) > 0 {
+			fmt.Fprintf(w, "%s{%s} %g\n", name, s.labels, s.value)
+		} else {
+			fmt.Fprintf(w, "%s %g\n", name, s.value)
+		}
+	}
+}
+
+// writeSummary writes a summary without quantiles, which gives the mean over any period
+func writeSummary(w io.Writer, name, help string, sum float64, count int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s summary\n%s_sum %g\n%s_count %d\n", name, help, name, name, sum, name, count)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// writeMetrics writes the metrics of the jobs, of the MQTT connection and of the mender installations
+func writeMetrics(w io.Writer, s awsiotjobs.Stats, m mender.Stats) {
+	writeMetric(w, "goagent_jobs_received_total", "counter", "Job executions received.", sample{"", float64(s.JobsReceived)})
+	writeMetric(w, "goagent_jobs_completed_total", "counter", "Job executions completed, by final status.",
+		sample{`status="succeeded"`, float64(s.JobsSucceeded)},
+		sample{`status="failed"`, float64(s.JobsFailed)},
+		sample{`status="rejected"`, float64(s.JobsRejected)})
+
+	writeMetric(w, "goagent_mqtt_connected", "gauge", "Whether the agent is connected to AWS IoT.", sample{"", boolValue(s.Connected)})
+	writeMetric(w, "goagent_mqtt_connects_total", "counter", "Successful connections to AWS IoT.", sample{"", float64(s.Connects)})
+	writeMetric(w, "goagent_mqtt_connect_failures_total", "counter", "Failed connection attempts.", sample{"", float64(s.ConnectFailures)})
+	writeMetric(w, "goagent_mqtt_disconnects_total", "counter", "Connections lost.", sample{"", float64(s.Disconnects)})
+	writeMetric(w, "goagent_mqtt_published_total", "counter", "Messages published.", sample{"", float64(s.Published)})
+	writeMetric(w, "goagent_mqtt_publish_failures_total", "counter", "Messages which could not be published.", sample{"", float64(s.PublishFailures)})
+	writeSummary(w, "goagent_mqtt_publish_latency_seconds", "Time until a publish completes.",
+		s.PublishLatencySum/1000, s.Published)
+	writeMetric(w, "goagent_mqtt_pending_acks", "gauge", "Publishes waiting for an acknowledgment.", sample{"", float64(s.PendingAcks)})
+	writeMetric(w, "goagent_mqtt_pending_requests", "gauge", "Requests waiting for a response.", sample{"", float64(s.PendingRequests)})
+	writeMetric(w, "goagent_outbox_messages", "gauge", "Messages waiting in the outbox.", sample{"", float64(s.Queued)})
+
+	writeMetric(w, "goagent_mender_install_failures_total", "counter", "Failed mender installations.", sample{"", float64(m.InstallFailures)})
+	writeSummary(w, "goagent_mender_install_duration_seconds", "Duration of the mender installations, successful or not.",
+		m.InstallDuration.Seconds(), m.Installs+m.InstallFailures)
+	writeMetric(w, "goagent_mender_downloaded_bytes_total", "counter", "Bytes of artifacts downloaded by mender.", sample{"", float64(m.DownloadedBytes)})
+}
+
+// serveMetrics serves the metrics on http://address/metrics until ctx is done. If the address cannot be
+// listened on, the error is logged and the agent runs without the metrics.
+func serveMetrics(ctx context.Context, address string, client *awsiotjobs.Client) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, client.Stats(), mender.GetStats())
+	})
+	server := &http.Server{Addr: address, Handler: mux, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	client.Logger().Info("Serving the metrics", awsiotjobs.F("url", "http://"+address+"/metrics"))
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		client.Logger().Error("Cannot serve the metrics", awsiotjobs.F("error", err))
+	}
+}
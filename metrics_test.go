@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/aws-iot-jobs-full-system-update/goagent/awsiotjobs"
+	"github.com/aws-samples/aws-iot-jobs-full-system-update/goagent/awsiotjobs/mender"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	s := awsiotjobs.Stats{
+		Connected:         true,
+		JobsReceived:      5,
+		JobsSucceeded:     4,
+		JobsFailed:        1,
+		Published:         4,
+		PublishLatency:    42.5,
+		PublishLatencySum: 170.25,
+	}
+	m := mender.Stats{Installs: 2, InstallFailures: 1, InstallDuration: 90 * time.Second}
+	var b bytes.Buffer
+	writeMetrics(&b, s, m)
+
+	for _, block := range []string{
+		"# HELP goagent_jobs_received_total Job executions received.\n" +
+			"# TYPE goagent_jobs_received_total counter\n" +
+			"goagent_jobs_received_total 5\n",
+		"# TYPE goagent_jobs_completed_total counter\n" +
+			"goagent_jobs_completed_total{status=\"succeeded\"} 4\n" +
+			"goagent_jobs_completed_total{status=\"failed\"} 1\n" +
+			"goagent_jobs_completed_total{status=\"rejected\"} 0\n",
+		"# HELP goagent_mqtt_connected Whether the agent is connected to AWS IoT.\n" +
+			"# TYPE goagent_mqtt_connected gauge\n" +
+			"goagent_mqtt_connected 1\n",
+		"# TYPE goagent_mqtt_publish_latency_seconds summary\n" +
+			"goagent_mqtt_publish_latency_seconds_sum 0.17025\n" +
+			"goagent_mqtt_publish_latency_seconds_count 4\n",
+		"# TYPE goagent_mender_install_duration_seconds summary\n" +
+			"goagent_mender_install_duration_seconds_sum 90\n" +
+			"goagent_mender_install_duration_seconds_count 3\n",
+	} {
+		if !strings.Contains(b.String(), block) {
+			t.Errorf("expected\n%s\nin the metrics:\n%s", block, b.String())
+		}
+	}
+}